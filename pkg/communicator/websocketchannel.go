@@ -16,7 +16,9 @@ package communicator
 
 import (
 	"errors"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/session-manager-plugin/pkg/config"
@@ -37,6 +39,8 @@ type IWebSocketChannel interface {
 	SetChannelToken(string)
 	SetOnError(onErrorHandler func(error))
 	SetOnMessage(onMessageHandler func([]byte))
+	SetLivenessTimeout(livenessTimeout time.Duration)
+	SetWebsocketOptions(options websocketutil.WebsocketOptions)
 }
 
 // WebSocketChannel parent class for DataChannel.
@@ -49,6 +53,12 @@ type WebSocketChannel struct {
 	writeLock    *sync.Mutex
 	Connection   *websocket.Conn
 	ChannelToken string
+	// LivenessTimeout is the time allowed without a pong or message before the connection is considered dead.
+	// A value of zero or less disables liveness tracking.
+	LivenessTimeout time.Duration
+	// Options are the handshake options used whenever the connection is opened or reopened.
+	Options      websocketutil.WebsocketOptions
+	pongReceived atomic.Bool
 }
 
 // GetChannelToken gets the channel token
@@ -76,6 +86,16 @@ func (webSocketChannel *WebSocketChannel) SetOnMessage(onMessageHandler func([]b
 	webSocketChannel.OnMessage = onMessageHandler
 }
 
+// SetLivenessTimeout sets LivenessTimeout field of websocket channel
+func (webSocketChannel *WebSocketChannel) SetLivenessTimeout(livenessTimeout time.Duration) {
+	webSocketChannel.LivenessTimeout = livenessTimeout
+}
+
+// SetWebsocketOptions sets the handshake options of websocket channel
+func (webSocketChannel *WebSocketChannel) SetWebsocketOptions(options websocketutil.WebsocketOptions) {
+	webSocketChannel.Options = options
+}
+
 // Initialize initializes websocket channel fields
 func (webSocketChannel *WebSocketChannel) Initialize(channelUrl string, channelToken string) {
 	webSocketChannel.ChannelToken = channelToken
@@ -84,16 +104,18 @@ func (webSocketChannel *WebSocketChannel) Initialize(channelUrl string, channelT
 
 // StartPings starts the pinging process to keep the websocket channel alive.
 func (webSocketChannel *WebSocketChannel) StartPings(pingInterval time.Duration) {
+	connection := webSocketChannel.Connection
 
 	go func() {
 		for {
-			if !webSocketChannel.IsOpen {
+			// stop pinging once the channel is closed or the connection has been replaced by a reconnect
+			if !webSocketChannel.IsOpen || webSocketChannel.Connection != connection {
 				return
 			}
 
 			log.Debug("WebsocketChannel: Send ping. Message.")
 			webSocketChannel.writeLock.Lock()
-			err := webSocketChannel.Connection.WriteMessage(websocket.PingMessage, []byte("keepalive"))
+			err := connection.WriteMessage(websocket.PingMessage, []byte("keepalive"))
 			webSocketChannel.writeLock.Unlock()
 			if err != nil {
 				log.Errorf("Error while sending websocket ping: %v", err)
@@ -104,6 +126,33 @@ func (webSocketChannel *WebSocketChannel) StartPings(pingInterval time.Duration)
 	}()
 }
 
+// pingInterval returns the ping interval, shortened so that several pings fit within the liveness timeout.
+func (webSocketChannel *WebSocketChannel) pingInterval() time.Duration {
+	if webSocketChannel.LivenessTimeout <= 0 {
+		return config.PingTimeInterval
+	}
+	if interval := webSocketChannel.LivenessTimeout / config.LivenessPingsPerTimeout; interval < config.PingTimeInterval {
+		return interval
+	}
+	return config.PingTimeInterval
+}
+
+// extendReadDeadline pushes the read deadline of the connection forward by the liveness timeout.
+// The deadline is only armed once the remote end has answered a ping, so endpoints that never send pongs
+// keep the previous behaviour of relying on read errors alone.
+func (webSocketChannel *WebSocketChannel) extendReadDeadline(connection *websocket.Conn) error {
+	if webSocketChannel.LivenessTimeout <= 0 || !webSocketChannel.pongReceived.Load() {
+		return nil
+	}
+	return connection.SetReadDeadline(time.Now().Add(webSocketChannel.LivenessTimeout))
+}
+
+// isLivenessTimeout checks if the read error was caused by an expired read deadline.
+func isLivenessTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 // SendMessage sends a byte message through the websocket connection.
 // Examples of message type are websocket.TextMessage or websocket.Binary
 func (webSocketChannel *WebSocketChannel) SendMessage(input []byte, inputType int) error {
@@ -140,13 +189,19 @@ func (webSocketChannel *WebSocketChannel) Open() error {
 	// initialize the write mutex
 	webSocketChannel.writeLock = &sync.Mutex{}
 
-	ws, err := websocketutil.NewWebsocketUtil(nil).OpenConnection(webSocketChannel.Url)
+	ws, err := websocketutil.NewWebsocketUtilWithOptions(nil, webSocketChannel.Options).OpenConnection(webSocketChannel.Url)
 	if err != nil {
 		return err
 	}
 	webSocketChannel.Connection = ws
 	webSocketChannel.IsOpen = true
-	webSocketChannel.StartPings(config.PingTimeInterval)
+	webSocketChannel.pongReceived.Store(false)
+	ws.SetPongHandler(func(string) error {
+		log.Trace("WebsocketChannel: Received pong.")
+		webSocketChannel.pongReceived.Store(true)
+		return webSocketChannel.extendReadDeadline(ws)
+	})
+	webSocketChannel.StartPings(webSocketChannel.pingInterval())
 
 	// spin up a different routine to listen to the incoming traffic
 	go func() {
@@ -164,8 +219,13 @@ func (webSocketChannel *WebSocketChannel) Open() error {
 				break
 			}
 
-			messageType, rawMessage, err := webSocketChannel.Connection.ReadMessage()
-			if err != nil {
+			messageType, rawMessage, err := ws.ReadMessage()
+			if err != nil && webSocketChannel.IsOpen && isLivenessTimeout(err) {
+				// a half-open connection will never recover, hand it to the reconnect path straight away
+				log.Errorf("No pong or message received within %v, connection is considered dead.", webSocketChannel.LivenessTimeout)
+				webSocketChannel.OnError(err)
+				break
+			} else if err != nil {
 				retryCount++
 				if retryCount >= config.RetryAttempt {
 					log.Errorf("Reach the retry limit %v for receive messages.", config.RetryAttempt)
@@ -182,6 +242,9 @@ func (webSocketChannel *WebSocketChannel) Open() error {
 
 			} else {
 				retryCount = 0
+				if err = webSocketChannel.extendReadDeadline(ws); err != nil {
+					log.Debugf("Failed to extend websocket read deadline: %v", err)
+				}
 				webSocketChannel.OnMessage(rawMessage)
 			}
 		}
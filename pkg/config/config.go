@@ -39,6 +39,13 @@ const (
 	DataChannelRetryMaxIntervalMillis  = 5000
 	RetryAttempt                       = 5
 	PingTimeInterval                   = 5 * time.Minute
+	DefaultLivenessTimeout             = 30 * time.Second
+	LivenessPingsPerTimeout            = 3
+	ConnectToPortRetryDelay            = 1 * time.Second
+	ConnectToPortRetryBufferSize       = 64 * 1024
+	DefaultSessionLimitWarning         = 1 * time.Minute
+	SessionLimitCheckInterval          = 1 * time.Second
+	DataChannelReadBufferSize          = 4 * 1024 * 1024
 
 	// Plugin names
 	ShellPluginName                  = "Standard_Stream"
@@ -46,5 +53,17 @@ const (
 	InteractiveCommandsPluginName    = "InteractiveCommands"
 	NonInteractiveCommandsPluginName = "NonInteractiveCommands"
 
+	// Port forwarding document names
+	PortForwardingDocumentName           = "AWS-StartPortForwardingSession"
+	RemoteHostPortForwardingDocumentName = "AWS-StartPortForwardingSessionToRemoteHost"
+
+	// Non-interactive command document name
+	NonInteractiveCommandDocumentName = "AWS-StartNonInteractiveCommand"
+
 	MinSupportedAgentVersion = "3.1.1511.0"
+
+	// Agents up to this version only forward one connection at a time per port session
+	TCPMultiplexingSupportedAfterThisAgentVersion = "3.0.196.0"
+	// Agents up to this version close multiplexed sessions without smux keepalives from the client
+	TCPMultiplexingWithSmuxKeepAliveDisabledAfterThisAgentVersion = "3.1.1511.0"
 )
@@ -24,6 +24,7 @@ import (
 	"math"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -71,6 +72,9 @@ type IDataChannel interface {
 	GetStreamDataSequenceNumber() int64
 	GetAgentVersion() string
 	SetAgentVersion(agentVersion string)
+	GetLastActivity() time.Time
+	GetResumeState() ResumeState
+	Resume(state ResumeState) error
 }
 
 // DataChannel used for communication between the mgs and the cli.
@@ -117,6 +121,9 @@ type DataChannel struct {
 
 	// AgentVersion received during handshake
 	agentVersion string
+
+	// lastActivity is the time in unix nanoseconds input was sent or output was received
+	lastActivity atomic.Int64
 }
 
 type ListMessageBuffer struct {
@@ -138,6 +145,27 @@ type StreamingMessage struct {
 	ResendAttempt  *int
 }
 
+// ResumeState is the state of a data channel that another client process needs to resume its session, refer to Resume.
+type ResumeState struct {
+	SessionType       string      `json:"sessionType"`
+	SessionProperties interface{} `json:"sessionProperties,omitempty"`
+	AgentVersion      string      `json:"agentVersion"`
+	// EncryptionEnabled sessions cannot be resumed, the data key is not part of the state
+	EncryptionEnabled bool `json:"encryptionEnabled"`
+	// ExpectedSequenceNumber is the sequence number of the next output message to process
+	ExpectedSequenceNumber int64 `json:"expectedSequenceNumber"`
+	// StreamDataSequenceNumber is the sequence number of the next input message to send
+	StreamDataSequenceNumber int64 `json:"streamDataSequenceNumber"`
+	// UnacknowledgedMessages are input messages the agent may not have received, they are sent again once resumed
+	UnacknowledgedMessages []UnacknowledgedMessage `json:"unacknowledgedMessages,omitempty"`
+}
+
+// UnacknowledgedMessage is a serialized input message that was sent but not acknowledged
+type UnacknowledgedMessage struct {
+	SequenceNumber int64  `json:"sequenceNumber"`
+	Content        []byte `json:"content"`
+}
+
 type OutputStreamDataMessageHandler func(streamDataMessage message.ClientMessage) (bool, error)
 
 type Stop func()
@@ -186,7 +214,7 @@ func (dataChannel *DataChannel) Initialize(clientId string, sessionId string, ta
 	dataChannel.RoundTripTime = float64(config.DefaultRoundTripTime)
 	dataChannel.RoundTripTimeVariation = config.DefaultRoundTripTimeVariation
 	dataChannel.RetransmissionTimeout = config.DefaultTransmissionTimeout
-	dataChannel.wsChannel = &communicator.WebSocketChannel{}
+	dataChannel.wsChannel = &communicator.WebSocketChannel{LivenessTimeout: config.DefaultLivenessTimeout}
 	dataChannel.encryptionEnabled = false
 	dataChannel.isSessionTypeSet = make(chan bool, 1)
 	dataChannel.isSessionEnded = false
@@ -281,6 +309,9 @@ func (dataChannel *DataChannel) SendInputDataMessage(
 	)
 
 	messageId := uuid.NewV4()
+	if payloadType == message.Output {
+		dataChannel.lastActivity.Store(time.Now().UnixNano())
+	}
 
 	// today 'enter' is taken as 'next line' in winpty shell. so hardcoding 'next line' byte to actual 'enter' byte
 	if bytes.Equal(inputData, []byte{10}) {
@@ -595,6 +626,7 @@ func (dataChannel *DataChannel) processOutputMessageWithHandlers(message message
 	if dataChannel.sessionType != "" && !dataChannel.isSessionSpecificHandlerSet {
 		return false, nil
 	}
+	dataChannel.lastActivity.Store(time.Now().UnixNano())
 	for _, handler := range dataChannel.outputStreamHandlers {
 		isHandlerReady, err = handler(message)
 		// Break the processing of message and return if session specific handler is not ready
@@ -711,6 +743,10 @@ func (dataChannel *DataChannel) HandleOutputMessage(
 				//Add message to buffer for future processing
 				dataChannel.AddDataToIncomingMessageBuffer(streamingMessage)
 			}
+		} else {
+			// The message was processed before and is sent again as its acknowledgement was lost,
+			// e.g. when the process that received it ended before acknowledging it and the session was resumed
+			return SendAcknowledgeMessageCall(dataChannel, outputMessage)
 		}
 	}
 	return nil
@@ -941,3 +977,56 @@ func (dataChannel *DataChannel) GetAgentVersion() string {
 func (dataChannel *DataChannel) SetAgentVersion(agentVersion string) {
 	dataChannel.agentVersion = agentVersion
 }
+
+// GetLastActivity returns the time input was last sent or output last received, zero before any
+func (dataChannel *DataChannel) GetLastActivity() time.Time {
+	if lastActivity := dataChannel.lastActivity.Load(); lastActivity != 0 {
+		return time.Unix(0, lastActivity)
+	}
+	return time.Time{}
+}
+
+// GetResumeState returns the state another client process needs to resume the session of this data channel
+func (dataChannel *DataChannel) GetResumeState() ResumeState {
+	state := ResumeState{
+		SessionType:              dataChannel.sessionType,
+		SessionProperties:        dataChannel.sessionProperties,
+		AgentVersion:             dataChannel.agentVersion,
+		EncryptionEnabled:        dataChannel.encryptionEnabled,
+		ExpectedSequenceNumber:   dataChannel.ExpectedSequenceNumber,
+		StreamDataSequenceNumber: dataChannel.StreamDataSequenceNumber,
+	}
+	dataChannel.OutgoingMessageBuffer.Mutex.Lock()
+	defer dataChannel.OutgoingMessageBuffer.Mutex.Unlock()
+	for element := dataChannel.OutgoingMessageBuffer.Messages.Front(); element != nil; element = element.Next() {
+		streamMessage := element.Value.(StreamingMessage)
+		state.UnacknowledgedMessages = append(state.UnacknowledgedMessages,
+			UnacknowledgedMessage{SequenceNumber: streamMessage.SequenceNumber, Content: streamMessage.Content})
+		// a message is buffered before the sequence number is incremented
+		state.StreamDataSequenceNumber = max(state.StreamDataSequenceNumber, streamMessage.SequenceNumber+1)
+	}
+	return state
+}
+
+// Resume continues the session of another client process from its state, after Initialize and before the data channel
+// is opened with a token of ResumeSession. Unacknowledged input is sent again by ResendStreamDataMessageScheduler.
+func (dataChannel *DataChannel) Resume(state ResumeState) error {
+	if state.EncryptionEnabled {
+		return errors.New("sessions with encryption cannot be resumed, the data key was lost with the process that started them")
+	}
+	dataChannel.ExpectedSequenceNumber = state.ExpectedSequenceNumber
+	dataChannel.StreamDataSequenceNumber = state.StreamDataSequenceNumber
+	dataChannel.agentVersion = state.AgentVersion
+	dataChannel.sessionProperties = state.SessionProperties
+	for _, unacknowledged := range state.UnacknowledgedMessages {
+		// a zero last sent time resends the message right away
+		dataChannel.AddDataToOutgoingMessageBuffer(StreamingMessage{
+			unacknowledged.Content,
+			unacknowledged.SequenceNumber,
+			time.Time{},
+			new(int),
+		})
+	}
+	dataChannel.SetSessionType(state.SessionType)
+	return nil
+}
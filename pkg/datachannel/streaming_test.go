@@ -0,0 +1,104 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// datachannel package implement data channel for interactive sessions.
+package datachannel
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/message"
+)
+
+func TestResumeState(t *testing.T) {
+	dataChannel := &DataChannel{}
+	dataChannel.Initialize("c-1", "s-1", "i-1", false)
+	dataChannel.SetSessionType(config.ShellPluginName)
+	<-dataChannel.IsSessionTypeSet()
+	dataChannel.SetAgentVersion("3.2.0.0")
+	dataChannel.ExpectedSequenceNumber = 12
+	dataChannel.StreamDataSequenceNumber = 4
+	dataChannel.AddDataToOutgoingMessageBuffer(StreamingMessage{[]byte("first"), 3, time.Now(), new(int)})
+	// buffered before the sequence number is incremented
+	dataChannel.AddDataToOutgoingMessageBuffer(StreamingMessage{[]byte("second"), 4, time.Now(), new(int)})
+
+	content, err := json.Marshal(dataChannel.GetResumeState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state ResumeState
+	if err = json.Unmarshal(content, &state); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := &DataChannel{}
+	resumed.Initialize("c-1", "s-1", "i-1", false)
+	if err = resumed.Resume(state); err != nil {
+		t.Fatalf("Resume() failed: %v", err)
+	}
+	if !<-resumed.IsSessionTypeSet() || resumed.GetSessionType() != config.ShellPluginName || resumed.GetAgentVersion() != "3.2.0.0" {
+		t.Errorf("resumed session type %q agent version %q, want those of the state", resumed.GetSessionType(), resumed.GetAgentVersion())
+	}
+	if resumed.ExpectedSequenceNumber != 12 || resumed.StreamDataSequenceNumber != 5 {
+		t.Errorf("resumed sequence numbers %d and %d, want 12 and 5", resumed.ExpectedSequenceNumber, resumed.StreamDataSequenceNumber)
+	}
+	var unacknowledged []string
+	for element := resumed.OutgoingMessageBuffer.Messages.Front(); element != nil; element = element.Next() {
+		streamMessage := element.Value.(StreamingMessage)
+		unacknowledged = append(unacknowledged, string(streamMessage.Content))
+		if !streamMessage.LastSentTime.IsZero() {
+			t.Errorf("message %d is not resent right away", streamMessage.SequenceNumber)
+		}
+	}
+	if len(unacknowledged) != 2 || unacknowledged[0] != "first" || unacknowledged[1] != "second" {
+		t.Errorf("resumed unacknowledged messages %q, want [first second]", unacknowledged)
+	}
+
+	state.EncryptionEnabled = true
+	encrypted := &DataChannel{}
+	encrypted.Initialize("c-1", "s-1", "i-1", false)
+	if err = encrypted.Resume(state); err == nil {
+		t.Error("Resume() of a session with encryption succeeded")
+	}
+}
+
+func TestHandleOutputMessageAcknowledgesProcessedMessages(t *testing.T) {
+	var acknowledged []int64
+	sendAcknowledgeMessage := SendAcknowledgeMessageCall
+	defer func() { SendAcknowledgeMessageCall = sendAcknowledgeMessage }()
+	SendAcknowledgeMessageCall = func(dataChannel *DataChannel, streamDataMessage message.ClientMessage) error {
+		acknowledged = append(acknowledged, streamDataMessage.SequenceNumber)
+		return nil
+	}
+
+	dataChannel := &DataChannel{}
+	dataChannel.Initialize("c-1", "s-1", "i-1", false)
+	dataChannel.ExpectedSequenceNumber = 5
+	processed := 0
+	dataChannel.RegisterOutputStreamHandler(func(message.ClientMessage) (bool, error) {
+		processed++
+		return true, nil
+	}, true)
+
+	// a message sent again after its acknowledgement was lost
+	if err := dataChannel.HandleOutputMessage(message.ClientMessage{SequenceNumber: 4, PayloadType: uint32(message.Output)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if processed != 0 || len(acknowledged) != 1 || acknowledged[0] != 4 || dataChannel.ExpectedSequenceNumber != 5 {
+		t.Errorf("processed %d, acknowledged %v, expecting %d, want the message acknowledged but not processed again",
+			processed, acknowledged, dataChannel.ExpectedSequenceNumber)
+	}
+}
@@ -46,3 +46,8 @@ func GetSDKConfig() aws.Config {
 func SetProfile(profile string) {
 	defaultProfile = profile
 }
+
+// GetProfile returns the profile set by SetProfile
+func GetProfile() string {
+	return defaultProfile
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+)
+
+var errPeerUidUnsupported = sessionutil.ErrPeerUidUnsupported
+
+// accessControl decides which connections accepted on a local listener are forwarded
+type accessControl struct {
+	allowedNetworks []*net.IPNet
+	allowedUids     map[int]bool
+}
+
+// newAccessControl builds the access control for the port options, it returns nil when no restriction is configured
+func newAccessControl(portOptions PortOptions) (*accessControl, error) {
+	if len(portOptions.AllowedSourceCIDRs) == 0 && len(portOptions.AllowedPeerUids) == 0 {
+		return nil, nil
+	}
+
+	a := &accessControl{allowedUids: make(map[int]bool)}
+	for _, cidr := range portOptions.AllowedSourceCIDRs {
+		if !strings.Contains(cidr, "/") {
+			// a single address is allowed without a prefix length
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source CIDR %s: %v", cidr, err)
+		}
+		a.allowedNetworks = append(a.allowedNetworks, network)
+	}
+	for _, uid := range portOptions.AllowedPeerUids {
+		a.allowedUids[uid] = true
+	}
+	if len(a.allowedUids) > 0 && !peerUidSupported {
+		return nil, errPeerUidUnsupported
+	}
+	return a, nil
+}
+
+// check returns an error describing why the connection is not allowed
+func (a *accessControl) check(conn net.Conn) error {
+	if a == nil {
+		return nil
+	}
+
+	switch remoteAddr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		if len(a.allowedNetworks) > 0 && !a.isNetworkAllowed(remoteAddr.IP) {
+			return fmt.Errorf("source address %s is not in the allowed CIDRs", remoteAddr.IP)
+		}
+		if len(a.allowedUids) > 0 {
+			if !remoteAddr.IP.IsLoopback() {
+				return fmt.Errorf("peer uid of non-loopback address %s cannot be verified", remoteAddr.IP)
+			}
+			uid, err := getTCPPeerUid(conn.LocalAddr().(*net.TCPAddr), remoteAddr)
+			if err != nil {
+				return fmt.Errorf("unable to determine peer uid: %v", err)
+			}
+			return a.checkUid(uid)
+		}
+	default:
+		if len(a.allowedUids) > 0 {
+			unixConn, ok := conn.(*net.UnixConn)
+			if !ok {
+				return fmt.Errorf("peer uid of %s connection cannot be verified", conn.RemoteAddr().Network())
+			}
+			uid, err := sessionutil.GetUnixPeerUid(unixConn)
+			if err != nil {
+				return fmt.Errorf("unable to determine peer uid: %v", err)
+			}
+			return a.checkUid(uid)
+		}
+	}
+	return nil
+}
+
+// isNetworkAllowed checks if the ip is part of an allowed network
+func (a *accessControl) isNetworkAllowed(ip net.IP) bool {
+	for _, network := range a.allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUid checks if the uid is allowed
+func (a *accessControl) checkUid(uid int) error {
+	if !a.allowedUids[uid] {
+		return fmt.Errorf("peer uid %d is not allowed", uid)
+	}
+	return nil
+}
+
+// acceptConnection waits for the next connection on the listener that passes the access control
+func acceptConnection(listener net.Listener, a *accessControl, sessionId string) (net.Conn, error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		if err = a.check(conn); err != nil {
+			log.Warnf("Rejected connection from %s for session [%s]: %v", conn.RemoteAddr(), sessionId, err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// applyUnixSocketPermissions sets mode and ownership of a unix socket file as configured in the port options
+func applyUnixSocketPermissions(path string, portOptions PortOptions) error {
+	if portOptions.UnixSocketMode != 0 {
+		if err := os.Chmod(path, portOptions.UnixSocketMode); err != nil {
+			return fmt.Errorf("unable to set mode of unix socket %s: %v", path, err)
+		}
+	}
+	if portOptions.UnixSocketOwner == "" && portOptions.UnixSocketGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if portOptions.UnixSocketOwner != "" {
+		owner, err := lookupId(portOptions.UnixSocketOwner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("unknown unix socket owner %s: %v", portOptions.UnixSocketOwner, err)
+		}
+		uid = owner
+	}
+	if portOptions.UnixSocketGroup != "" {
+		group, err := lookupId(portOptions.UnixSocketGroup, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("unknown unix socket group %s: %v", portOptions.UnixSocketGroup, err)
+		}
+		gid = group
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("unable to set ownership of unix socket %s: %v", path, err)
+	}
+	return nil
+}
+
+// lookupId returns the numeric id for a name or numeric id
+func lookupId(nameOrId string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrId); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrId)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
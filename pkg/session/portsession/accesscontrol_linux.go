@@ -0,0 +1,101 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build linux
+// +build linux
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const peerUidSupported = true
+
+// procNetTcpFiles lists the kernel socket tables searched for the peer of a loopback tcp connection
+var procNetTcpFiles = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+var errSocketNotFound = fmt.Errorf("peer socket not found in %s", strings.Join(procNetTcpFiles, ", "))
+
+// getTCPPeerUid returns the uid owning the peer end of a loopback tcp connection.
+// The peer socket has the accepted connection's remote address as its local address and vice versa.
+func getTCPPeerUid(localAddr *net.TCPAddr, remoteAddr *net.TCPAddr) (int, error) {
+	for _, procFile := range procNetTcpFiles {
+		uid, err := findSocketUid(procFile, remoteAddr, localAddr)
+		if err == nil {
+			return uid, nil
+		}
+		if !os.IsNotExist(err) && err != errSocketNotFound {
+			return -1, err
+		}
+	}
+	return -1, errSocketNotFound
+}
+
+// findSocketUid searches a /proc/net/tcp style table for a socket with the given addresses
+func findSocketUid(procFile string, localAddr *net.TCPAddr, remoteAddr *net.TCPAddr) (int, error) {
+	file, err := os.Open(procFile)
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// skip the header line
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		if !procAddrEqual(fields[1], localAddr) || !procAddrEqual(fields[2], remoteAddr) {
+			continue
+		}
+		return strconv.Atoi(fields[7])
+	}
+	if err = scanner.Err(); err != nil {
+		return -1, err
+	}
+	return -1, errSocketNotFound
+}
+
+// procAddrEqual compares an address in /proc/net/tcp notation, e.g. 0100007F:1F90, with a tcp address
+func procAddrEqual(procAddr string, addr *net.TCPAddr) bool {
+	hexIp, hexPort, found := strings.Cut(procAddr, ":")
+	if !found {
+		return false
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil || int(port) != addr.Port {
+		return false
+	}
+	rawIp, err := hex.DecodeString(hexIp)
+	if err != nil || len(rawIp)%4 != 0 {
+		return false
+	}
+	// the kernel prints the address as 32 bit words in host byte order
+	ip := make(net.IP, len(rawIp))
+	for i := 0; i < len(rawIp); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(rawIp[i:]))
+	}
+	return ip.Equal(addr.IP)
+}
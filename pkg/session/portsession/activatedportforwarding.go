@@ -0,0 +1,125 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/aws/session-manager-plugin/pkg/session"
+)
+
+const (
+	// ListenFdsStart is the first file descriptor passed by systemd socket activation
+	ListenFdsStart = 3
+	ListenPidEnv   = "LISTEN_PID"
+	ListenFdsEnv   = "LISTEN_FDS"
+)
+
+// pendingConnListener returns a connection accepted before the session was started, then accepts from the listener
+type pendingConnListener struct {
+	net.Listener
+	once sync.Once
+	conn net.Conn
+}
+
+// Accept returns the pending connection on the first call
+func (l *pendingConnListener) Accept() (conn net.Conn, err error) {
+	l.once.Do(func() {
+		conn, l.conn = l.conn, nil
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	return l.Listener.Accept()
+}
+
+// GetInheritedListener returns the listener on listenerFd, or the listener passed by systemd
+// socket activation through LISTEN_FDS and LISTEN_PID when listenerFd is zero.
+func GetInheritedListener(listenerFd int) (net.Listener, error) {
+	if listenerFd <= 0 {
+		var err error
+		if listenerFd, err = getSystemdListenerFd(); err != nil {
+			return nil, err
+		}
+	}
+
+	file := os.NewFile(uintptr(listenerFd), "listener"+strconv.Itoa(listenerFd))
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not a listening socket: %v", listenerFd, err)
+	}
+	return listener, nil
+}
+
+// getSystemdListenerFd returns the first file descriptor passed by systemd, refer - sd_listen_fds(3)
+func getSystemdListenerFd() (int, error) {
+	// the variables are only meant for this process, do not pass them on to children
+	defer os.Unsetenv(ListenPidEnv)
+	defer os.Unsetenv(ListenFdsEnv)
+
+	if pid, err := strconv.Atoi(os.Getenv(ListenPidEnv)); err != nil || pid != os.Getpid() {
+		return -1, errors.New("no listener was passed by socket activation")
+	}
+	fds, err := strconv.Atoi(os.Getenv(ListenFdsEnv))
+	if err != nil || fds < 1 {
+		return -1, errors.New("no listener was passed by socket activation")
+	}
+	if fds > 1 {
+		log.Warnf("%d file descriptors were passed by socket activation, only the first one is used.", fds)
+	}
+	return ListenFdsStart, nil
+}
+
+// StartActivatedPortForwarding waits for the first connection on an inherited listener, then starts the port session
+// through the given document and serves the connection and all further ones on that listener.
+func StartActivatedPortForwarding(target, profile, ssmEndpoint, documentName string, parameters map[string][]string, listenerFd int, portOptions PortOptions) error {
+	listener, err := GetInheritedListener(listenerFd)
+	if err != nil {
+		return err
+	}
+
+	accessControl, err := newAccessControl(portOptions)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	log.Infof("Waiting for the first connection on %s to start the session.", listener.Addr())
+	conn, err := acceptConnection(listener, accessControl, "")
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	sdkutil.SetProfile(profile)
+	portSession, err := session.CreateSession(target, documentName, parameters, ssmEndpoint)
+	if err != nil {
+		conn.Close()
+		listener.Close()
+		return err
+	}
+
+	portOptions.Listener = &pendingConnListener{Listener: listener, conn: conn}
+	portSession.PluginOptions = portOptions
+	return portSession.Execute()
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/session-manager-plugin/pkg/config"
@@ -30,13 +31,21 @@ import (
 )
 
 // BasicPortForwarding is type of port session
-// accepts one client connection at a time
+// forwards one client connection at a time, further clients are queued or get an additional session
 type BasicPortForwarding struct {
-	stream         net.Conn
-	listener       net.Listener
-	sessionId      string
-	portParameters PortParameters
-	session        session.Session
+	stream             net.Conn
+	listener           net.Listener
+	sessionId          string
+	portParameters     PortParameters
+	portOptions        PortOptions
+	accessControl      *accessControl
+	events             *portEventWriter
+	connectionId       uint64
+	retry              *connectRetry
+	clients            *clientQueue
+	clientSessions     map[*session.Session]struct{}
+	clientSessionsLock sync.Mutex
+	session            session.Session
 }
 
 // IsStreamNotSet checks if stream is not set
@@ -50,11 +59,22 @@ func (p *BasicPortForwarding) Stop() {
 	if p.stream != nil {
 		p.stream.Close()
 	}
+	p.stopClientSessions()
+	p.events.close()
 }
 
 // InitializeStreams establishes connection and initializes the stream
 func (p *BasicPortForwarding) InitializeStreams(agentVersion string) (err error) {
 	p.handleControlSignals()
+	p.retry = newConnectRetry(p.portOptions)
+	p.clientSessions = make(map[*session.Session]struct{})
+	if p.portOptions.ClientMode == ClientModeSession && p.session.DocumentName == "" {
+		log.Warnf("Document of session %s is unknown, concurrent clients are queued instead of getting an additional session.", p.sessionId)
+		p.portOptions.ClientMode = ClientModeQueue
+	}
+	if p.events, err = newPortEventWriter(p.portOptions); err != nil {
+		return
+	}
 	if err = p.startLocalConn(); err != nil {
 		return
 	}
@@ -79,6 +99,10 @@ func (p *BasicPortForwarding) ReadStream() (err error) {
 			if err = p.reconnect(); err != nil {
 				return err
 			}
+			if p.stream == nil {
+				// session ended while waiting for the next client
+				return nil
+			}
 
 			// continue to read from connection as it has been re-established
 			continue
@@ -89,6 +113,7 @@ func (p *BasicPortForwarding) ReadStream() (err error) {
 			log.Errorf("Failed to send packet: %v", err)
 			return err
 		}
+		p.retry.recordInput(msg[:numBytes])
 		// Sleep to process more data
 		time.Sleep(time.Millisecond)
 	}
@@ -96,10 +121,31 @@ func (p *BasicPortForwarding) ReadStream() (err error) {
 
 // WriteStream writes data to stream
 func (p *BasicPortForwarding) WriteStream(outputMessage message.ClientMessage) error {
+	if message.PayloadType(outputMessage.PayloadType) == message.Flag {
+		if flag, err := getFlag(outputMessage.Payload); err != nil {
+			log.Debugf("Ignoring invalid flag payload: %v", err)
+		} else if flag == message.ConnectToPortError {
+			p.handleConnectToPortError()
+		}
+		return nil
+	}
+
+	p.retry.markConnected()
 	_, err := p.stream.Write(outputMessage.Payload)
 	return err
 }
 
+// handleConnectToPortError sends the unanswered input again, or closes the local connection when no retry is left
+func (p *BasicPortForwarding) handleConnectToPortError() {
+	if p.retry.retry(p.session.DataChannel, p.portParameters.PortNumber) {
+		return
+	}
+
+	log.Errorf("Connection to destination port %s failed, check SSM Agent logs. Closing local connection.", p.portParameters.PortNumber)
+	// the failing read on the closed connection notifies the agent and waits for the next client
+	p.stream.Close()
+}
+
 // startLocalConn establishes a new local connection to forward remote server packets to
 func (p *BasicPortForwarding) startLocalConn() (err error) {
 	// When localPortNumber is not specified, set port number to 0 to let net.conn choose an open port at random
@@ -113,7 +159,10 @@ func (p *BasicPortForwarding) startLocalConn() (err error) {
 		return err
 	}
 
-	if p.stream, err = p.listener.Accept(); err != nil {
+	p.clients = newClientQueue(p.sessionId, p.portOptions.ClientQueueTimeout)
+	go p.acceptClients()
+
+	if p.stream, err = p.clients.next(); err != nil {
 		if !p.session.DataChannel.IsSessionEnded() {
 			log.Errorf("Failed to accept connection with error. %v", err)
 			return err
@@ -121,6 +170,7 @@ func (p *BasicPortForwarding) startLocalConn() (err error) {
 	}
 	if !p.session.DataChannel.IsSessionEnded() {
 		log.Infof("Connection accepted for session %s.", p.sessionId)
+		p.connectionId = p.events.connectionAccepted(p.sessionId, p.stream)
 	}
 
 	return
@@ -129,27 +179,60 @@ func (p *BasicPortForwarding) startLocalConn() (err error) {
 // startLocalListener starts a local listener to given address
 func (p *BasicPortForwarding) startLocalListener(portNumber string) (err error) {
 	var displayMessage string
-	switch p.portParameters.LocalConnectionType {
-	case "unix":
-		if p.listener, err = net.Listen(p.portParameters.LocalConnectionType, p.portParameters.LocalUnixSocket); err != nil {
+	if p.accessControl, err = newAccessControl(p.portOptions); err != nil {
+		return
+	}
+	switch {
+	case p.portOptions.Listener != nil:
+		p.listener = p.portOptions.Listener
+		displayMessage = getInheritedListenerMessage(p.listener, &p.portParameters, p.sessionId)
+	case p.portParameters.LocalConnectionType == "unix":
+		if p.listener, err = sessionutil.ListenUnixSocket(p.portParameters.LocalUnixSocket); err != nil {
+			return
+		}
+		if err = applyUnixSocketPermissions(p.portParameters.LocalUnixSocket, p.portOptions); err != nil {
+			p.listener.Close()
 			return
 		}
 		displayMessage = fmt.Sprintf("Unix socket %s opened for sessionId %s.", p.portParameters.LocalUnixSocket, p.sessionId)
 	default:
-		if p.listener, err = net.Listen("tcp", "localhost:"+portNumber); err != nil {
+		if p.listener, err = net.Listen("tcp", getLocalAddress(p.portParameters, portNumber)); err != nil {
 			return
 		}
+		warnIfNotLoopback(p.listener)
 		// get port number the TCP listener opened
 		p.portParameters.LocalPortNumber = strconv.Itoa(p.listener.Addr().(*net.TCPAddr).Port)
 		displayMessage = fmt.Sprintf("Port %s opened for sessionId %s.", p.portParameters.LocalPortNumber, p.sessionId)
 	}
 
 	log.Info(displayMessage)
+	p.events.listenerReady(p.sessionId, p.listener, p.portParameters)
+	p.portOptions.notifyListenerReady(p.sessionId, p.listener, p.portParameters)
 	return
 }
 
+// acceptClients accepts client connections until the listener is closed.
+// Clients arriving while another one is served wait in the queue or get an additional session, depending on the client mode.
+func (p *BasicPortForwarding) acceptClients() {
+	for {
+		conn, err := acceptConnection(p.listener, p.accessControl, p.sessionId)
+		if err != nil {
+			p.clients.fail(err)
+			return
+		}
+		if p.portOptions.ClientMode == ClientModeSession && p.clients.isBusy() {
+			go p.startClientSession(conn)
+			continue
+		}
+		p.clients.push(conn)
+	}
+}
+
 // handleControlSignals handles terminate signals
 func (p *BasicPortForwarding) handleControlSignals() {
+	if p.session.Supervised {
+		return
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, sessionutil.ControlSignals...)
 	go func() {
@@ -171,14 +254,19 @@ func (p *BasicPortForwarding) handleControlSignals() {
 func (p *BasicPortForwarding) reconnect() (err error) {
 	// close existing connection as it is in a state from which data cannot be read
 	p.stream.Close()
+	p.events.connectionClosed(p.sessionId, p.connectionId, p.stream, transferStats{})
 
-	// wait for new connection on listener and accept it
-	if p.stream, err = p.listener.Accept(); err != nil {
+	// wait for the next queued client
+	if p.stream, err = p.clients.next(); err != nil {
 		if !p.session.DataChannel.IsSessionEnded() {
 			log.Errorf("Failed to accept connection with error. %v", err)
 			return err
 		}
 	}
+	if p.stream != nil {
+		p.connectionId = p.events.connectionAccepted(p.sessionId, p.stream)
+	}
+	p.retry.reset()
 
 	return
 }
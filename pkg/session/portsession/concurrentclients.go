@@ -0,0 +1,266 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/session"
+)
+
+const (
+	// ClientModeQueue serves clients one after another, clients arriving meanwhile wait in a queue
+	ClientModeQueue = "queue"
+	// ClientModeSession starts an additional session for every client arriving while another one is served
+	ClientModeSession = "session"
+
+	DefaultClientQueueTimeout = 60 * time.Second
+)
+
+// clientQueue holds the clients waiting for a port session that forwards one connection at a time
+type clientQueue struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	sessionId string
+	timeout   time.Duration
+	clients   []*queuedClient
+	busy      bool
+	err       error
+}
+
+// queuedClient is a waiting client connection, closed when it waits longer than the queue timeout
+type queuedClient struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+// newClientQueue creates an empty queue, a timeout of zero or less uses DefaultClientQueueTimeout
+func newClientQueue(sessionId string, timeout time.Duration) *clientQueue {
+	if timeout <= 0 {
+		timeout = DefaultClientQueueTimeout
+	}
+	q := &clientQueue{sessionId: sessionId, timeout: timeout}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// isBusy returns true while a client is being served
+func (q *clientQueue) isBusy() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.busy
+}
+
+// push adds a client to the end of the queue and reports its position when it has to wait
+func (q *clientQueue) push(conn net.Conn) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	client := &queuedClient{conn: conn}
+	client.timer = time.AfterFunc(q.timeout, func() { q.expire(client) })
+	q.clients = append(q.clients, client)
+	if q.busy {
+		log.Alwaysf("Connection from %s is waiting for session %s, %d client(s) queued.", conn.RemoteAddr(), q.sessionId, len(q.clients))
+	}
+	q.cond.Signal()
+}
+
+// expire closes a client that is still queued after the timeout
+func (q *clientQueue) expire(client *queuedClient) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, c := range q.clients {
+		if c == client {
+			q.clients = append(q.clients[:i], q.clients[i+1:]...)
+			log.Warnf("Connection from %s waited longer than %v for session %s and was closed, %d client(s) queued.",
+				client.conn.RemoteAddr(), q.timeout, q.sessionId, len(q.clients))
+			client.conn.Close()
+			return
+		}
+	}
+}
+
+// next marks the current client as done and waits for the next queued client.
+// It returns the error that ended accepting clients once the queue is empty.
+func (q *clientQueue) next() (net.Conn, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.busy = false
+	for len(q.clients) == 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if len(q.clients) == 0 {
+		return nil, q.err
+	}
+
+	client := q.clients[0]
+	q.clients = q.clients[1:]
+	client.timer.Stop()
+	q.busy = true
+	if len(q.clients) > 0 {
+		log.Alwaysf("Connection from %s is forwarded through session %s, %d client(s) queued.", client.conn.RemoteAddr(), q.sessionId, len(q.clients))
+	}
+	return client.conn, nil
+}
+
+// fail records the error that ended accepting clients and closes the waiting clients
+func (q *clientQueue) fail(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.err = err
+	for _, client := range q.clients {
+		client.timer.Stop()
+		client.conn.Close()
+	}
+	q.clients = nil
+	q.cond.Broadcast()
+}
+
+// singleConnListener hands out a single accepted connection, further Accept calls block until the listener is closed
+type singleConnListener struct {
+	conn      net.Conn
+	addr      net.Addr
+	once      sync.Once
+	closeOnce sync.Once
+	connDone  chan struct{}
+	closed    chan struct{}
+}
+
+// newSingleConnListener creates a listener for conn, connDone is closed once the connection is closed
+func newSingleConnListener(conn net.Conn, addr net.Addr) *singleConnListener {
+	return &singleConnListener{
+		conn:     conn,
+		addr:     addr,
+		connDone: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Accept returns the connection on the first call
+func (l *singleConnListener) Accept() (conn net.Conn, err error) {
+	l.once.Do(func() {
+		conn = &notifyingConn{Conn: l.conn, done: l.connDone}
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+// Close unblocks pending Accept calls
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns the address of the listener the connection was accepted on
+func (l *singleConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+// notifyingConn closes done when the connection is closed
+type notifyingConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+// Close closes the connection and notifies the listener
+func (c *notifyingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
+
+// startClientSession forwards a single client connection through an additional port session
+// with the same target, document and parameters, and terminates that session once the client disconnects.
+func (p *BasicPortForwarding) startClientSession(conn net.Conn) {
+	clientSession, err := session.CreateSession(p.session.TargetId, p.session.DocumentName, p.session.Parameters, p.session.Endpoint)
+	if err != nil {
+		log.Errorf("Unable to start an additional session for connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if !p.addClientSession(clientSession) {
+		clientSession.TerminateSession()
+		conn.Close()
+		return
+	}
+	defer p.removeClientSession(clientSession)
+
+	listener := newSingleConnListener(conn, p.listener.Addr())
+	clientSession.Supervised = true
+	clientSession.LivenessTimeout = p.session.LivenessTimeout
+	clientSession.WebsocketOptions = p.session.WebsocketOptions
+	clientSession.Limits = p.session.Limits
+	clientSession.PluginOptions = PortOptions{
+		DisableMultiplexing:  true,
+		ClientMode:           ClientModeQueue,
+		ConnectRetryAttempts: p.portOptions.ConnectRetryAttempts,
+		ConnectRetryDelay:    p.portOptions.ConnectRetryDelay,
+		Listener:             listener,
+	}
+
+	go func() {
+		select {
+		case <-listener.connDone:
+			clientSession.EndSession()
+		case <-listener.closed:
+		}
+		listener.Close()
+	}()
+
+	log.Alwaysf("Connection from %s is forwarded through additional session %s.", conn.RemoteAddr(), clientSession.SessionId)
+	if err = clientSession.Execute(); err != nil {
+		log.Errorf("Additional session %s ended with error: %v", clientSession.SessionId, err)
+	}
+	conn.Close()
+	log.Infof("Additional session %s closed.", clientSession.SessionId)
+}
+
+// addClientSession tracks an additional session, it returns false when the port session is stopping
+func (p *BasicPortForwarding) addClientSession(clientSession *session.Session) bool {
+	p.clientSessionsLock.Lock()
+	defer p.clientSessionsLock.Unlock()
+	if p.clientSessions == nil {
+		return false
+	}
+	p.clientSessions[clientSession] = struct{}{}
+	return true
+}
+
+// removeClientSession stops tracking an additional session
+func (p *BasicPortForwarding) removeClientSession(clientSession *session.Session) {
+	p.clientSessionsLock.Lock()
+	defer p.clientSessionsLock.Unlock()
+	delete(p.clientSessions, clientSession)
+}
+
+// stopClientSessions terminates all additional sessions and prevents new ones
+func (p *BasicPortForwarding) stopClientSessions() {
+	p.clientSessionsLock.Lock()
+	defer p.clientSessionsLock.Unlock()
+	for clientSession := range p.clientSessions {
+		clientSession.EndSession()
+	}
+	p.clientSessions = nil
+}
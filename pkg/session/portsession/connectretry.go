@@ -0,0 +1,122 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/datachannel"
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/message"
+)
+
+// connectRetry keeps the input sent on a connection until the agent has connected to the destination port,
+// so that the input can be sent again when the agent reports ConnectToPortError.
+// The agent dials the destination port when it receives input and drops that input if dialing fails.
+type connectRetry struct {
+	lock        sync.Mutex
+	maxAttempts int
+	delay       time.Duration
+	attempts    int
+	connected   bool
+	overflow    bool
+	input       [][]byte
+	inputSize   int
+}
+
+// newConnectRetry creates the retry state from the port options
+func newConnectRetry(portOptions PortOptions) *connectRetry {
+	delay := portOptions.ConnectRetryDelay
+	if delay <= 0 {
+		delay = config.ConnectToPortRetryDelay
+	}
+	return &connectRetry{maxAttempts: portOptions.ConnectRetryAttempts, delay: delay}
+}
+
+// reset starts tracking a new local connection
+func (r *connectRetry) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.attempts = 0
+	r.connected = false
+	r.overflow = false
+	r.input = nil
+	r.inputSize = 0
+}
+
+// recordInput keeps a copy of input sent before the destination port answered
+func (r *connectRetry) recordInput(data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.maxAttempts <= 0 || r.connected || r.overflow {
+		return
+	}
+	if r.inputSize+len(data) > config.ConnectToPortRetryBufferSize {
+		// too much unanswered input to replay, a retry is no longer possible
+		r.overflow = true
+		r.input = nil
+		return
+	}
+	r.input = append(r.input, bytes.Clone(data))
+	r.inputSize += len(data)
+}
+
+// markConnected records that output from the destination port was received
+func (r *connectRetry) markConnected() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.connected = true
+	r.input = nil
+}
+
+// next returns the input to send again for the next attempt, ok is false when no attempt is left
+func (r *connectRetry) next() (input [][]byte, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.connected || r.overflow || r.attempts >= r.maxAttempts {
+		return nil, false
+	}
+	r.attempts++
+	return r.input, true
+}
+
+// retry sends the unanswered input on the data channel again after the retry delay, it returns false when no attempt is left
+func (r *connectRetry) retry(dataChannel datachannel.IDataChannel, portNumber string) bool {
+	input, ok := r.next()
+	if !ok {
+		return false
+	}
+	log.Warnf("Connection to destination port %s failed, retrying in %v.", portNumber, r.delay)
+	go func() {
+		time.Sleep(r.delay)
+		for _, data := range input {
+			if err := dataChannel.SendInputDataMessage(message.Output, data); err != nil {
+				log.Errorf("Failed to send packet: %v", err)
+				return
+			}
+		}
+	}()
+	return true
+}
+
+// getFlag decodes the payload of a Flag message
+func getFlag(payload []byte) (flag message.PayloadTypeFlag, err error) {
+	err = binary.Read(bytes.NewBuffer(payload), binary.BigEndian, &flag)
+	return
+}
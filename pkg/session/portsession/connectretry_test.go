@@ -0,0 +1,133 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/datachannel"
+	"github.com/aws/session-manager-plugin/pkg/message"
+)
+
+// inputRecorder is a data channel that records the input messages sent on it
+type inputRecorder struct {
+	datachannel.IDataChannel
+	sent chan string
+}
+
+func (r *inputRecorder) SendInputDataMessage(payloadType message.PayloadType, inputData []byte) error {
+	r.sent <- string(inputData)
+	return nil
+}
+
+func TestConnectRetryNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		// steps is a sequence of "input:<data>", "connected", "reset" and "next"
+		steps []string
+		// next is the input returned by each "next" step, nil when no attempt is left
+		next [][]string
+	}{
+		{name: "retries disabled", attempts: 0, steps: []string{"input:GET", "next"}, next: [][]string{nil}},
+		{name: "input is sent again", attempts: 2, steps: []string{"input:GET ", "input:/", "next", "next", "next"},
+			next: [][]string{{"GET ", "/"}, {"GET ", "/"}, nil}},
+		{name: "no retry once connected", attempts: 2, steps: []string{"input:GET", "connected", "next"}, next: [][]string{nil}},
+		{name: "reset starts a new connection", attempts: 1, steps: []string{"input:a", "next", "reset", "input:b", "next"},
+			next: [][]string{{"a"}, {"b"}}},
+		{name: "too much input to replay", attempts: 2,
+			steps: []string{"input:" + strings.Repeat("x", config.ConnectToPortRetryBufferSize), "input:y", "next"},
+			next:  [][]string{nil}},
+	}
+	for _, test := range tests {
+		r := newConnectRetry(PortOptions{ConnectRetryAttempts: test.attempts})
+		var next [][]string
+		for _, step := range test.steps {
+			switch {
+			case strings.HasPrefix(step, "input:"):
+				r.recordInput([]byte(strings.TrimPrefix(step, "input:")))
+			case step == "connected":
+				r.markConnected()
+			case step == "reset":
+				r.reset()
+			case step == "next":
+				input, ok := r.next()
+				if !ok {
+					next = append(next, nil)
+					continue
+				}
+				sent := []string{}
+				for _, data := range input {
+					sent = append(sent, string(data))
+				}
+				next = append(next, sent)
+			}
+		}
+		if !reflect.DeepEqual(next, test.next) {
+			t.Errorf("%s: next() returned %q, want %q", test.name, next, test.next)
+		}
+	}
+}
+
+func TestConnectRetryRecordInputCopies(t *testing.T) {
+	r := newConnectRetry(PortOptions{ConnectRetryAttempts: 1})
+	data := []byte("GET")
+	r.recordInput(data)
+	copy(data, "PUT")
+	if input, _ := r.next(); len(input) != 1 || string(input[0]) != "GET" {
+		t.Errorf("next() = %q, want the input as it was sent", input)
+	}
+}
+
+func TestConnectRetryRetry(t *testing.T) {
+	recorder := &inputRecorder{sent: make(chan string, 2)}
+	r := newConnectRetry(PortOptions{ConnectRetryAttempts: 1, ConnectRetryDelay: 10 * time.Millisecond})
+	r.recordInput([]byte("a"))
+	r.recordInput([]byte("b"))
+
+	if !r.retry(recorder, "80") {
+		t.Fatal("retry() = false, want an attempt")
+	}
+	for _, want := range []string{"a", "b"} {
+		select {
+		case sent := <-recorder.sent:
+			if sent != want {
+				t.Errorf("sent %q, want %q", sent, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("input %q was not sent again", want)
+		}
+	}
+	if r.retry(recorder, "80") {
+		t.Error("retry() = true after the last attempt")
+	}
+}
+
+func TestGetFlag(t *testing.T) {
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.BigEndian, message.ConnectToPortError)
+	if flag, err := getFlag(payload.Bytes()); err != nil || flag != message.ConnectToPortError {
+		t.Errorf("getFlag() = %v, %v, want %v", flag, err, message.ConnectToPortError)
+	}
+	if _, err := getFlag([]byte{0}); err == nil {
+		t.Error("getFlag() of a short payload succeeded")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+)
+
+const DefaultDialerIdleTimeout = 5 * time.Minute
+
+// Dialer opens connections to remote ports through SSM port sessions without opening any local port.
+// Connections to the same target, host and port share one session, which ends after the idle timeout
+// once all its connections are closed.
+type Dialer struct {
+	sessions *sessionPool
+}
+
+var (
+	defaultDialer     *Dialer
+	defaultDialerOnce sync.Once
+)
+
+// NewDialer creates a dialer using the given AWS profile and SSM endpoint, which may be empty for the defaults.
+// An idle timeout of zero or less uses DefaultDialerIdleTimeout.
+func NewDialer(profile, ssmEndpoint string, idleTimeout time.Duration) *Dialer {
+	sdkutil.SetProfile(profile)
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultDialerIdleTimeout
+	}
+	return &Dialer{sessions: newSessionPool(ssmEndpoint, idleTimeout)}
+}
+
+// Dial connects to remotePort on remoteHost through target using a shared default dialer.
+// An empty remoteHost connects to remotePort on the target itself.
+func Dial(ctx context.Context, target, remoteHost, remotePort string) (net.Conn, error) {
+	defaultDialerOnce.Do(func() {
+		defaultDialer = &Dialer{sessions: newSessionPool("", DefaultDialerIdleTimeout)}
+	})
+	return defaultDialer.Dial(ctx, target, remoteHost, remotePort)
+}
+
+// Dial connects to remotePort on remoteHost through target, starting a port session when none is running.
+// An empty remoteHost connects to remotePort on the target itself. ctx bounds the wait for the session,
+// which keeps starting in the background for later dials when ctx is done first.
+// The connection reports target as its local and the remote host and port as its remote address.
+func (d *Dialer) Dial(ctx context.Context, target, remoteHost, remotePort string) (net.Conn, error) {
+	address := net.JoinHostPort(remoteHost, remotePort)
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("dial %s through %s: %w", address, target, err)
+	}
+	s, err := d.sessions.acquire(ctx, target, address)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s through %s: %w", address, target, err)
+	}
+
+	stream, err := s.openStream()
+	if err != nil {
+		d.sessions.release(s)
+		return nil, fmt.Errorf("dial %s through %s: %w", address, target, err)
+	}
+	return &dialedConn{
+		Conn:       stream,
+		localAddr:  sessionutil.DataChannelAddr(target),
+		remoteAddr: sessionutil.DataChannelAddr(address),
+		release:    func() { d.sessions.release(s) },
+	}, nil
+}
+
+// DialContextFunc returns a function dialing "host:port" addresses through target,
+// e.g. for http.Transport.DialContext or grpc.WithContextDialer. The network is ignored.
+func (d *Dialer) DialContextFunc(target string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial(ctx, target, host, port)
+	}
+}
+
+// Close terminates all sessions of the dialer, open connections are closed with them
+func (d *Dialer) Close() error {
+	d.sessions.close()
+	return nil
+}
+
+// dialedConn is a stream of a shared port session, closing it releases the session
+type dialedConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	once       sync.Once
+	release    func()
+}
+
+// LocalAddr returns the target the connection goes through
+func (c *dialedConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr returns the remote host and port the connection goes to
+func (c *dialedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Close closes the stream and releases the session
+func (c *dialedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
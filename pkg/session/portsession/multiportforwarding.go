@@ -0,0 +1,286 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/aws/session-manager-plugin/pkg/session"
+	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+)
+
+const (
+	// MultiPortForwardingStopTimeout is the time given to sessions to close after termination was requested
+	MultiPortForwardingStopTimeout = 5 * time.Second
+)
+
+// PortMapping describes a single forward from a local port to a port on the target or on a remote host.
+type PortMapping struct {
+	LocalHost        string
+	LocalPortNumber  string
+	RemoteHost       string
+	RemotePortNumber string
+}
+
+// MultiPortForwarding runs one port session per mapping against a single target and supervises them together
+type MultiPortForwarding struct {
+	target      string
+	ssmEndpoint string
+	mappings    []PortMapping
+	sessions    []*session.Session
+	listeners   map[string]ListenerInfo
+	// failures are the errors of sessions that ended before their listener was ready, by session id
+	failures map[string]error
+	lock     sync.Mutex
+}
+
+// ParsePortMapping parses a mapping in the form [localHost:]localPort:[remoteHost:]remotePort.
+// IPv6 hosts must be enclosed in brackets, e.g. [::1]:8080:[fd00::10]:80.
+// With three fields the host is taken to be the local host when the first field is not a port number,
+// e.g. 127.0.0.1:8080:80, and the remote host otherwise, e.g. 8080:db.internal:5432.
+func ParsePortMapping(spec string) (mapping PortMapping, err error) {
+	fields := splitHostPortList(spec)
+	switch len(fields) {
+	case 2:
+		mapping.LocalPortNumber, mapping.RemotePortNumber = fields[0], fields[1]
+	case 3:
+		firstIsPort, secondIsPort := isPortNumber(fields[0]), isPortNumber(fields[1])
+		switch {
+		case firstIsPort && !secondIsPort:
+			mapping.LocalPortNumber, mapping.RemoteHost, mapping.RemotePortNumber = fields[0], fields[1], fields[2]
+		case !firstIsPort && secondIsPort:
+			mapping.LocalHost, mapping.LocalPortNumber, mapping.RemotePortNumber = fields[0], fields[1], fields[2]
+		default:
+			return mapping, fmt.Errorf("ambiguous port mapping %q, expected localHost:localPort:remotePort or localPort:remoteHost:remotePort", spec)
+		}
+	case 4:
+		mapping.LocalHost, mapping.LocalPortNumber, mapping.RemoteHost, mapping.RemotePortNumber = fields[0], fields[1], fields[2], fields[3]
+	default:
+		return mapping, fmt.Errorf("invalid port mapping %q, expected [localHost:]localPort:[remoteHost:]remotePort", spec)
+	}
+	if mapping.RemotePortNumber == "" {
+		return mapping, fmt.Errorf("invalid port mapping %q, remote port is missing", spec)
+	}
+	if mapping.LocalPortNumber != "" && !isPortNumber(mapping.LocalPortNumber) {
+		return mapping, fmt.Errorf("invalid port mapping %q, local port %q is not a number between 1 and 65535", spec, mapping.LocalPortNumber)
+	}
+	if !isPortNumber(mapping.RemotePortNumber) {
+		return mapping, fmt.Errorf("invalid port mapping %q, remote port %q is not a number between 1 and 65535", spec, mapping.RemotePortNumber)
+	}
+	return mapping, nil
+}
+
+// isPortNumber returns true if value is a decimal port number between 1 and 65535
+func isPortNumber(value string) bool {
+	port, err := strconv.ParseUint(value, 10, 16)
+	return err == nil && port > 0
+}
+
+// splitHostPortList splits spec on colons that are not enclosed in brackets and strips the brackets.
+func splitHostPortList(spec string) (fields []string) {
+	depth, start := 0, 0
+	for i, c := range spec {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				fields = append(fields, strings.Trim(spec[start:i], "[]"))
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, strings.Trim(spec[start:], "[]"))
+}
+
+// String returns the mapping in the form accepted by ParsePortMapping.
+func (m PortMapping) String() string {
+	spec := m.LocalPortNumber
+	if m.LocalHost != "" {
+		spec = net.JoinHostPort(m.LocalHost, m.LocalPortNumber)
+	}
+	if m.RemoteHost != "" {
+		return fmt.Sprintf("%s:%s", spec, net.JoinHostPort(m.RemoteHost, m.RemotePortNumber))
+	}
+	return fmt.Sprintf("%s:%s", spec, m.RemotePortNumber)
+}
+
+// documentName returns the SSM document used to start the session for the mapping.
+func (m PortMapping) documentName() string {
+	if m.RemoteHost != "" {
+		return config.RemoteHostPortForwardingDocumentName
+	}
+	return config.PortForwardingDocumentName
+}
+
+// documentParameters returns the SSM document parameters used to start the session for the mapping.
+func (m PortMapping) documentParameters() map[string][]string {
+	parameters := map[string][]string{
+		"portNumber": {m.RemotePortNumber},
+	}
+	if m.LocalPortNumber != "" {
+		parameters["localPortNumber"] = []string{m.LocalPortNumber}
+	}
+	if m.RemoteHost != "" {
+		parameters["host"] = []string{m.RemoteHost}
+	}
+	return parameters
+}
+
+// StartMultiPortForwarding starts a port session for every mapping and blocks until all of them have ended.
+func StartMultiPortForwarding(target, profile, ssmEndpoint string, mappings []PortMapping) error {
+	if len(mappings) == 0 {
+		return fmt.Errorf("no port mappings given for target %s", target)
+	}
+	sdkutil.SetProfile(profile)
+
+	m := &MultiPortForwarding{
+		target:      target,
+		ssmEndpoint: ssmEndpoint,
+		mappings:    mappings,
+		listeners:   make(map[string]ListenerInfo),
+		failures:    make(map[string]error),
+	}
+	return m.run()
+}
+
+// run starts the sessions, waits for them to end and terminates all of them on a control signal.
+func (m *MultiPortForwarding) run() error {
+	for _, mapping := range m.mappings {
+		portSession, err := session.CreateSession(m.target, mapping.documentName(), mapping.documentParameters(), m.ssmEndpoint)
+		if err != nil {
+			m.terminate()
+			return fmt.Errorf("unable to start port forwarding %s: %v", mapping, err)
+		}
+		portSession.Supervised = true
+		portSession.PluginOptions = PortOptions{LocalHost: mapping.LocalHost, OnListenerReady: m.onListenerReady}
+		m.sessions = append(m.sessions, portSession)
+	}
+
+	log.Alwaysf("Starting %d port forwarding sessions to %s.", len(m.sessions), m.target)
+
+	done := make(chan struct{})
+	var (
+		wait     sync.WaitGroup
+		errsLock sync.Mutex
+		errs     []error
+	)
+	for i, portSession := range m.sessions {
+		wait.Add(1)
+		go func(mapping PortMapping, portSession *session.Session) {
+			defer wait.Done()
+			if err := portSession.Execute(); err != nil {
+				log.Errorf("Port forwarding %s ended with error: %v", mapping, err)
+				errsLock.Lock()
+				errs = append(errs, fmt.Errorf("port forwarding %s: %w", mapping, err))
+				errsLock.Unlock()
+				m.onSessionFailed(portSession.SessionId, err)
+			}
+			log.Alwaysf("Port forwarding %s for session %s closed.", mapping, portSession.SessionId)
+		}(m.mappings[i], portSession)
+	}
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sessionutil.ControlSignals...)
+	defer signal.Stop(signals)
+
+	select {
+	case <-done:
+		return errors.Join(errs...)
+	case <-signals:
+		log.Always("Terminate signal received, exiting.")
+	}
+
+	m.terminate()
+	select {
+	case <-done:
+	case <-time.After(MultiPortForwardingStopTimeout):
+		log.Warnf("Port forwarding sessions did not close within %v.", MultiPortForwardingStopTimeout)
+	}
+	errsLock.Lock()
+	defer errsLock.Unlock()
+	return errors.Join(errs...)
+}
+
+// onListenerReady records a ready listener and prints the combined status once every session is ready or has failed
+func (m *MultiPortForwarding) onListenerReady(listenerInfo ListenerInfo) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.listeners[listenerInfo.SessionId] = listenerInfo
+	m.reportStatus()
+}
+
+// onSessionFailed records a session that ended before its listener was ready
+func (m *MultiPortForwarding) onSessionFailed(sessionId string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ready := m.listeners[sessionId]; ready {
+		return
+	}
+	m.failures[sessionId] = err
+	m.reportStatus()
+}
+
+// reportStatus prints the combined status once every session is ready or has failed, m.lock must be held
+func (m *MultiPortForwarding) reportStatus() {
+	if len(m.listeners)+len(m.failures) != len(m.sessions) {
+		return
+	}
+
+	var status strings.Builder
+	fmt.Fprintf(&status, "Forwarding %d of %d ports to %s:\n", len(m.listeners), len(m.sessions), m.target)
+	for i, portSession := range m.sessions {
+		mapping := m.mappings[i]
+		remote := mapping.RemotePortNumber
+		if mapping.RemoteHost != "" {
+			remote = net.JoinHostPort(mapping.RemoteHost, mapping.RemotePortNumber)
+		}
+		if err, failed := m.failures[portSession.SessionId]; failed {
+			fmt.Fprintf(&status, "  %s failed: %v (session %s)\n", mapping, err, portSession.SessionId)
+			continue
+		}
+		fmt.Fprintf(&status, "  %s -> %s (session %s)\n", m.listeners[portSession.SessionId].Address, remote, portSession.SessionId)
+	}
+	if len(m.listeners) > 0 {
+		fmt.Fprint(&status, "Waiting for connections...")
+	}
+	log.Always(status.String())
+}
+
+// terminate ends all sessions that have been started
+func (m *MultiPortForwarding) terminate() {
+	for _, portSession := range m.sessions {
+		portSession.EndSession()
+	}
+}
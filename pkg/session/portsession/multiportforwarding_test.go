@@ -0,0 +1,80 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		spec    string
+		mapping PortMapping
+		wantErr bool
+	}{
+		{spec: "8080:80", mapping: PortMapping{LocalPortNumber: "8080", RemotePortNumber: "80"}},
+		{spec: ":80", mapping: PortMapping{RemotePortNumber: "80"}},
+		{spec: "5432:db.internal:5432", mapping: PortMapping{LocalPortNumber: "5432", RemoteHost: "db.internal", RemotePortNumber: "5432"}},
+		{spec: "127.0.0.1:8080:80", mapping: PortMapping{LocalHost: "127.0.0.1", LocalPortNumber: "8080", RemotePortNumber: "80"}},
+		{spec: "localhost:8080:db:5432", mapping: PortMapping{LocalHost: "localhost", LocalPortNumber: "8080", RemoteHost: "db", RemotePortNumber: "5432"}},
+		{spec: "[::1]:8080:[fd00::1]:80", mapping: PortMapping{LocalHost: "::1", LocalPortNumber: "8080", RemoteHost: "fd00::1", RemotePortNumber: "80"}},
+		{spec: "8080:[fd00::1]:80", mapping: PortMapping{LocalPortNumber: "8080", RemoteHost: "fd00::1", RemotePortNumber: "80"}},
+		{spec: "65535:1", mapping: PortMapping{LocalPortNumber: "65535", RemotePortNumber: "1"}},
+		// both readings of three fields are possible
+		{spec: "8080:8081:80", wantErr: true},
+		{spec: "local:remote:80", wantErr: true},
+		{spec: "80", wantErr: true},
+		{spec: "a:1:b:2:3", wantErr: true},
+		{spec: "8080:", wantErr: true},
+		{spec: "8080:0", wantErr: true},
+		{spec: "8080:65536", wantErr: true},
+		{spec: "http:80", wantErr: true},
+		{spec: "8080:-1", wantErr: true},
+	}
+	for _, test := range tests {
+		mapping, err := ParsePortMapping(test.spec)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParsePortMapping(%q) = %+v, want error", test.spec, mapping)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePortMapping(%q) failed: %v", test.spec, err)
+		} else if mapping != test.mapping {
+			t.Errorf("ParsePortMapping(%q) = %+v, want %+v", test.spec, mapping, test.mapping)
+		}
+	}
+}
+
+func TestSplitHostPortList(t *testing.T) {
+	tests := []struct {
+		spec   string
+		fields []string
+	}{
+		{spec: "", fields: []string{""}},
+		{spec: "80", fields: []string{"80"}},
+		{spec: "8080:host:80", fields: []string{"8080", "host", "80"}},
+		{spec: "[::1]:8080", fields: []string{"::1", "8080"}},
+		{spec: "[fe80::1%eth0]:8080:[::1]:80", fields: []string{"fe80::1%eth0", "8080", "::1", "80"}},
+		{spec: "::", fields: []string{"", "", ""}},
+	}
+	for _, test := range tests {
+		if fields := splitHostPortList(test.spec); !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("splitHostPortList(%q) = %q, want %q", test.spec, fields, test.fields)
+		}
+	}
+}
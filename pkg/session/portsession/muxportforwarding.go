@@ -15,21 +15,16 @@
 package portsession
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"net"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/aws/session-manager-plugin/pkg/config"
 	"github.com/aws/session-manager-plugin/pkg/log"
 	"github.com/aws/session-manager-plugin/pkg/message"
 	"github.com/aws/session-manager-plugin/pkg/session"
@@ -38,81 +33,89 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-// MuxClient contains smux client session and corresponding network connection
+// MuxClient contains smux client session and its transport over the data channel
 type MuxClient struct {
-	conn          net.Conn
+	conn          *sessionutil.DataChannelConn
 	localListener net.Listener
 	session       *smux.Session
 }
 
-// MgsConn contains local server and corresponding connection to smux client
-type MgsConn struct {
-	listener net.Listener
-	conn     net.Conn
-}
-
 // MuxPortForwarding is type of port session
 // accepts multiple client connections through multiplexing
 type MuxPortForwarding struct {
 	port           IPortSession
 	sessionId      string
-	socketFile     string
 	portParameters PortParameters
+	portOptions    PortOptions
+	accessControl  *accessControl
+	events         *portEventWriter
 	session        session.Session
 	muxClient      *MuxClient
-	mgsConn        *MgsConn
-}
-
-func (c *MgsConn) close() {
-	c.listener.Close()
-	c.conn.Close()
 }
 
 func (c *MuxClient) close() {
 	c.session.Close()
 	c.conn.Close()
-	c.localListener.Close()
+	if c.localListener != nil {
+		c.localListener.Close()
+	}
+}
+
+// muxStreamOpener opens streams on the smux client session of a port session
+type muxStreamOpener struct {
+	session *smux.Session
+}
+
+// OpenStream opens a new stream to the remote port
+func (o *muxStreamOpener) OpenStream() (net.Conn, error) {
+	return o.session.OpenStream()
 }
 
 // IsStreamNotSet checks if stream is not set
 func (p *MuxPortForwarding) IsStreamNotSet() (status bool) {
-	return p.muxClient.conn == nil
+	return p.muxClient == nil || p.muxClient.conn == nil
 }
 
 // Stop closes all open stream
 func (p *MuxPortForwarding) Stop() {
-	if p.mgsConn != nil {
-		p.mgsConn.close()
-	}
 	if p.muxClient != nil {
 		p.muxClient.close()
 	}
-	p.cleanUp()
+	p.events.close()
 }
 
 // InitializeStreams initializes i/o streams
 func (p *MuxPortForwarding) InitializeStreams(agentVersion string) (err error) {
 
 	p.handleControlSignals()
-	p.socketFile = getUnixSocketPath(p.sessionId, os.TempDir(), "session_manager_plugin_mux.sock")
-
-	if err = p.initialize(agentVersion); err != nil {
-		p.cleanUp()
+	if p.events, err = newPortEventWriter(p.portOptions); err != nil {
+		return
 	}
-	return
+	return p.initialize(agentVersion)
 }
 
 // ReadStream reads data from different connections
 func (p *MuxPortForwarding) ReadStream() (err error) {
 	g, ctx := errgroup.WithContext(context.Background())
 
-	// reads data from smux client and transfers to server over datachannel
+	// ends the session handlers once the smux client session is closed
 	g.Go(func() error {
-		return p.transferDataToServer(ctx)
+		select {
+		case <-p.muxClient.session.CloseChan():
+			return io.ErrClosedPipe
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	})
 
-	// set up network listener on SSM port and handle client connections
+	// set up network listener on SSM port and handle client connections,
+	// or hand the mux session to the caller when it opens streams itself
 	g.Go(func() error {
+		if p.portOptions.OnStreamOpenerReady != nil {
+			p.portOptions.OnStreamOpenerReady(&muxStreamOpener{p.muxClient.session})
+			<-ctx.Done()
+			return ctx.Err()
+		}
 		return p.handleClientConnections(ctx)
 	})
 
@@ -133,13 +136,9 @@ func (p *MuxPortForwarding) ReadStream() (err error) {
 func (p *MuxPortForwarding) WriteStream(outputMessage message.ClientMessage) error {
 	switch message.PayloadType(outputMessage.PayloadType) {
 	case message.Output:
-		_, err := p.mgsConn.conn.Write(outputMessage.Payload)
-		return err
+		return p.muxClient.conn.Push(outputMessage.Payload)
 	case message.Flag:
-		var flag message.PayloadTypeFlag
-		buf := bytes.NewBuffer(outputMessage.Payload)
-		binary.Read(buf, binary.BigEndian, &flag)
-
+		flag, _ := getFlag(outputMessage.Payload)
 		if message.ConnectToPortError == flag {
 			log.Error("Connection to destination port failed, check SSM Agent logs.")
 		}
@@ -147,53 +146,26 @@ func (p *MuxPortForwarding) WriteStream(outputMessage message.ClientMessage) err
 	return nil
 }
 
-// cleanUp deletes unix socket file
-func (p *MuxPortForwarding) cleanUp() {
-	os.Remove(p.socketFile)
-}
-
-// initialize opens a network connection that acts as smux client
+// initialize sets up the client side of mux over the data channel
 func (p *MuxPortForwarding) initialize(agentVersion string) (err error) {
-
-	// open a network listener
-	var listener net.Listener
-	if listener, err = sessionutil.NewListener(p.socketFile); err != nil {
+	smuxConfig, err := getSmuxConfig(agentVersion, p.portOptions.Smux)
+	if err != nil {
 		return
 	}
-
-	var g errgroup.Group
-	// start a go routine to accept connections on the network listener
-	g.Go(func() error {
-		if conn, err := listener.Accept(); err != nil {
-			return err
-		} else {
-			p.mgsConn = &MgsConn{listener, conn}
-		}
-		return nil
-	})
-
-	// start a connection to the local network listener and set up client side of mux
-	g.Go(func() error {
-		if muxConn, err := net.Dial(listener.Addr().Network(), listener.Addr().String()); err != nil {
-			return err
-		} else {
-			smuxConfig := smux.DefaultConfig()
-			smuxConfig.KeepAliveDisabled = true
-			if muxSession, err := smux.Client(muxConn, smuxConfig); err != nil {
-				return err
-			} else {
-				var localListener net.Listener
-				p.muxClient = &MuxClient{muxConn, localListener, muxSession}
-			}
-		}
-		return nil
-	})
-
-	return g.Wait()
+	muxConn := sessionutil.NewDataChannelConn(p.session.DataChannel, p.sessionId, p.session.TargetId)
+	muxSession, err := smux.Client(muxConn, smuxConfig)
+	if err != nil {
+		return
+	}
+	p.muxClient = &MuxClient{conn: muxConn, session: muxSession}
+	return
 }
 
 // handleControlSignals handles terminate signals
 func (p *MuxPortForwarding) handleControlSignals() {
+	if p.session.Supervised {
+		return
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, sessionutil.ControlSignals...)
 	go func() {
@@ -207,39 +179,25 @@ func (p *MuxPortForwarding) handleControlSignals() {
 	}()
 }
 
-// transferDataToServer reads from smux client connection and sends on data channel
-func (p *MuxPortForwarding) transferDataToServer(ctx context.Context) (err error) {
-	msg := make([]byte, config.StreamDataPayloadSize)
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			var numBytes int
-			if numBytes, err = p.mgsConn.conn.Read(msg); err != nil {
-				log.Debugf("Reading from port failed with error: %v.", err)
-				return
-			}
-
-			log.Tracef("Received message of size %d from mux client.", numBytes)
-			if err = p.session.DataChannel.SendInputDataMessage(message.Output, msg[:numBytes]); err != nil {
-				log.Errorf("Failed to send packet on data channel: %v", err)
-				return
-			}
-			// sleep to process more data
-			time.Sleep(time.Millisecond)
-		}
-	}
-}
-
 // handleClientConnections sets up network server on local ssm port to accept connections from clients (browser/terminal)
 func (p *MuxPortForwarding) handleClientConnections(ctx context.Context) (err error) {
 	var (
 		displayMsg string
 	)
 
-	if p.portParameters.LocalConnectionType == "unix" {
-		if p.muxClient.localListener, err = net.Listen(p.portParameters.LocalConnectionType, p.portParameters.LocalUnixSocket); err != nil {
+	if p.accessControl, err = newAccessControl(p.portOptions); err != nil {
+		return err
+	}
+
+	if p.portOptions.Listener != nil {
+		p.muxClient.localListener = p.portOptions.Listener
+		displayMsg = getInheritedListenerMessage(p.muxClient.localListener, &p.portParameters, p.sessionId)
+	} else if p.portParameters.LocalConnectionType == "unix" {
+		if p.muxClient.localListener, err = sessionutil.ListenUnixSocket(p.portParameters.LocalUnixSocket); err != nil {
+			return err
+		}
+		if err = applyUnixSocketPermissions(p.portParameters.LocalUnixSocket, p.portOptions); err != nil {
+			p.muxClient.localListener.Close()
 			return err
 		}
 		displayMsg = fmt.Sprintf("Unix socket %s opened for sessionId %s.", p.portParameters.LocalUnixSocket, p.sessionId)
@@ -248,9 +206,10 @@ func (p *MuxPortForwarding) handleClientConnections(ctx context.Context) (err er
 		if p.portParameters.LocalPortNumber == "" {
 			localPortNumber = "0"
 		}
-		if p.muxClient.localListener, err = net.Listen("tcp", "localhost:"+localPortNumber); err != nil {
+		if p.muxClient.localListener, err = net.Listen("tcp", getLocalAddress(p.portParameters, localPortNumber)); err != nil {
 			return err
 		}
+		warnIfNotLoopback(p.muxClient.localListener)
 		p.portParameters.LocalPortNumber = strconv.Itoa(p.muxClient.localListener.Addr().(*net.TCPAddr).Port)
 		displayMsg = fmt.Sprintf("Port %s opened for sessionId %s.", p.portParameters.LocalPortNumber, p.sessionId)
 	}
@@ -258,6 +217,8 @@ func (p *MuxPortForwarding) handleClientConnections(ctx context.Context) (err er
 	defer p.muxClient.localListener.Close()
 
 	log.Info(displayMsg)
+	p.events.listenerReady(p.sessionId, p.muxClient.localListener, p.portParameters)
+	p.portOptions.notifyListenerReady(p.sessionId, p.muxClient.localListener, p.portParameters)
 
 	log.Info("Waiting for connections...\n")
 
@@ -267,7 +228,7 @@ func (p *MuxPortForwarding) handleClientConnections(ctx context.Context) (err er
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			if conn, err := p.muxClient.localListener.Accept(); err != nil {
+			if conn, err := acceptConnection(p.muxClient.localListener, p.accessControl, p.sessionId); err != nil {
 				log.Errorf("Error while accepting connection: %v", err)
 			} else {
 				log.Infof("Connection accepted from %s\n for session [%s]", conn.RemoteAddr(), p.sessionId)
@@ -276,40 +237,21 @@ func (p *MuxPortForwarding) handleClientConnections(ctx context.Context) (err er
 					log.Alwaysf("\nConnection accepted for session [%s]\n", p.sessionId)
 				})
 
+				connectionId := p.events.connectionAccepted(p.sessionId, conn)
 				stream, err := p.muxClient.session.OpenStream()
 				if err != nil {
+					conn.Close()
+					p.events.connectionClosed(p.sessionId, connectionId, conn, transferStats{})
 					continue
 				}
 				log.Debugf("Client stream opened %d\n", stream.ID())
-				go handleDataTransfer(stream, conn)
+				go func() {
+					stats := newStreamTransfer(stream, conn, p.portOptions).run()
+					log.Infof("Connection from %s closed for session [%s] after %v, %d bytes sent, %d bytes received.",
+						conn.RemoteAddr(), p.sessionId, stats.Duration.Round(time.Millisecond), stats.BytesSent, stats.BytesReceived)
+					p.events.connectionClosed(p.sessionId, connectionId, conn, stats)
+				}()
 			}
 		}
 	}
 }
-
-// handleDataTransfer launches routines to transfer data between source and destination
-func handleDataTransfer(dst io.ReadWriteCloser, src io.ReadWriteCloser) {
-	var wait sync.WaitGroup
-	wait.Add(2)
-
-	go func() {
-		io.Copy(dst, src)
-		dst.Close()
-		wait.Done()
-	}()
-
-	go func() {
-		io.Copy(src, dst)
-		src.Close()
-		wait.Done()
-	}()
-
-	wait.Wait()
-}
-
-// getUnixSocketPath generates the unix socket file name based on sessionId and returns the path.
-func getUnixSocketPath(sessionId string, dir string, suffix string) string {
-	hash := fnv.New32a()
-	hash.Write([]byte(sessionId))
-	return filepath.Join(dir, fmt.Sprintf("%d_%s", hash.Sum32(), suffix))
-}
@@ -0,0 +1,165 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+)
+
+const (
+	PortEventReady            = "ready"
+	PortEventConnectionAccept = "connection_accept"
+	PortEventConnectionClose  = "connection_close"
+)
+
+// PortEvent is a machine readable record of the state of a port session, written as one JSON object per line
+type PortEvent struct {
+	Event            string    `json:"event"`
+	Time             time.Time `json:"time"`
+	SessionId        string    `json:"sessionId"`
+	Network          string    `json:"network,omitempty"`
+	LocalAddress     string    `json:"localAddress,omitempty"`
+	LocalPortNumber  string    `json:"localPortNumber,omitempty"`
+	LocalUnixSocket  string    `json:"localUnixSocket,omitempty"`
+	RemoteHost       string    `json:"remoteHost,omitempty"`
+	RemotePortNumber string    `json:"remotePortNumber,omitempty"`
+	ConnectionId     uint64    `json:"connectionId,omitempty"`
+	ClientAddress    string    `json:"clientAddress,omitempty"`
+	BytesSent        int64     `json:"bytesSent,omitempty"`
+	BytesReceived    int64     `json:"bytesReceived,omitempty"`
+}
+
+// portEventWriter writes port events to the output configured in the port options, a nil writer discards events
+type portEventWriter struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	// opened is the events file opened by the writer, inherited descriptors are never closed
+	opened       *os.File
+	connectionId atomic.Uint64
+}
+
+var (
+	inheritedFilesLock sync.Mutex
+	// inheritedFiles keeps the files of inherited descriptors referenced, os.File closes its descriptor once collected
+	inheritedFiles = map[int]*os.File{}
+)
+
+// inheritedFile returns the file of an inherited descriptor, shared by all writers using it
+func inheritedFile(fd int) *os.File {
+	inheritedFilesLock.Lock()
+	defer inheritedFilesLock.Unlock()
+	file, ok := inheritedFiles[fd]
+	if !ok {
+		file = os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+		inheritedFiles[fd] = file
+	}
+	return file
+}
+
+// newPortEventWriter opens the events output of the port options, it returns nil when none is configured
+func newPortEventWriter(portOptions PortOptions) (*portEventWriter, error) {
+	switch {
+	case portOptions.EventsFd > 0:
+		return &portEventWriter{encoder: json.NewEncoder(inheritedFile(portOptions.EventsFd))}, nil
+	case portOptions.EventsFile != "":
+		file, err := os.OpenFile(portOptions.EventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open events file %s: %v", portOptions.EventsFile, err)
+		}
+		return &portEventWriter{encoder: json.NewEncoder(file), opened: file}, nil
+	}
+	return nil, nil
+}
+
+// listenerReady writes the readiness record of the local listener
+func (w *portEventWriter) listenerReady(sessionId string, listener net.Listener, portParameters PortParameters) {
+	if w == nil {
+		return
+	}
+	event := PortEvent{
+		Event:            PortEventReady,
+		SessionId:        sessionId,
+		Network:          listener.Addr().Network(),
+		LocalAddress:     listener.Addr().String(),
+		RemoteHost:       portParameters.Host,
+		RemotePortNumber: portParameters.PortNumber,
+	}
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+		event.LocalPortNumber = strconv.Itoa(tcpAddr.Port)
+	} else {
+		event.LocalUnixSocket = listener.Addr().String()
+	}
+	w.write(event)
+}
+
+// connectionAccepted writes an accept record for a client connection and returns the id assigned to it
+func (w *portEventWriter) connectionAccepted(sessionId string, conn net.Conn) uint64 {
+	if w == nil {
+		return 0
+	}
+	connectionId := w.connectionId.Add(1)
+	w.write(PortEvent{
+		Event:         PortEventConnectionAccept,
+		SessionId:     sessionId,
+		ConnectionId:  connectionId,
+		ClientAddress: conn.RemoteAddr().String(),
+	})
+	return connectionId
+}
+
+// connectionClosed writes a close record for a client connection with the bytes transferred, if counted
+func (w *portEventWriter) connectionClosed(sessionId string, connectionId uint64, conn net.Conn, stats transferStats) {
+	if w == nil {
+		return
+	}
+	w.write(PortEvent{
+		Event:         PortEventConnectionClose,
+		SessionId:     sessionId,
+		ConnectionId:  connectionId,
+		ClientAddress: conn.RemoteAddr().String(),
+		BytesSent:     stats.BytesSent,
+		BytesReceived: stats.BytesReceived,
+	})
+}
+
+// close closes the events file, an inherited descriptor stays open
+func (w *portEventWriter) close() {
+	if w == nil || w.opened == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.opened.Close()
+}
+
+// write encodes the event as a single line
+func (w *portEventWriter) write(event PortEvent) {
+	event.Time = time.Now().UTC()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.encoder.Encode(event); err != nil {
+		log.Debugf("Failed to write %s event: %v", event.Event, err)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPortEventWriterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	writer, err := newPortEventWriter(PortOptions{EventsFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	writer.listenerReady("s-1", listener, PortParameters{Host: "db.internal", PortNumber: "5432"})
+	writer.close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event PortEvent
+	if err := json.Unmarshal(content, &event); err != nil {
+		t.Fatalf("events file %q is not a single JSON event: %v", content, err)
+	}
+	if event.Event != PortEventReady || event.SessionId != "s-1" || event.LocalAddress != listener.Addr().String() ||
+		event.RemoteHost != "db.internal" || event.RemotePortNumber != "5432" {
+		t.Errorf("ready event %+v does not describe the listener", event)
+	}
+}
+
+func TestPortEventWriterKeepsInheritedFdOpen(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	defer writer.Close()
+	defer func() {
+		inheritedFilesLock.Lock()
+		delete(inheritedFiles, int(writer.Fd()))
+		inheritedFilesLock.Unlock()
+	}()
+
+	for i := 0; i < 2; i++ {
+		events, err := newPortEventWriter(PortOptions{EventsFd: int(writer.Fd())})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events.write(PortEvent{Event: PortEventConnectionAccept, SessionId: "s-1"})
+		events.close()
+	}
+	if _, err := writer.Write([]byte("{}\n")); err != nil {
+		t.Fatalf("inherited descriptor was closed with the event writer: %v", err)
+	}
+
+	lines := bufio.NewScanner(reader)
+	for i := 0; i < 3; i++ {
+		if !lines.Scan() {
+			t.Fatalf("line %d missing: %v", i, lines.Err())
+		}
+	}
+}
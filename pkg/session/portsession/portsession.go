@@ -15,20 +15,30 @@
 package portsession
 
 import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/aws/session-manager-plugin/pkg/config"
 	"github.com/aws/session-manager-plugin/pkg/jsonutil"
 	"github.com/aws/session-manager-plugin/pkg/log"
 	"github.com/aws/session-manager-plugin/pkg/message"
 	"github.com/aws/session-manager-plugin/pkg/session"
+	"github.com/aws/session-manager-plugin/pkg/version"
 )
 
 const (
 	LocalPortForwardingType = "LocalPortForwarding"
+	DefaultLocalHost        = "localhost"
 )
 
 type PortSession struct {
 	session.Session
 	portParameters  PortParameters
+	portOptions     PortOptions
 	portSessionType IPortSession
 }
 
@@ -45,9 +55,69 @@ type PortParameters struct {
 	LocalPortNumber     string `json:"localPortNumber"`
 	LocalUnixSocket     string `json:"localUnixSocket"`
 	LocalConnectionType string `json:"localConnectionType"`
+	LocalHost           string `json:"localHost"`
+	Host                string `json:"host"`
 	Type                string `json:"type"`
 }
 
+// PortOptions are client side options of a port session, passed in through session.Session.PluginOptions.
+type PortOptions struct {
+	// LocalHost overrides the localHost parameter of the session, e.g. "0.0.0.0" or "::1".
+	LocalHost string
+	// AllowedSourceCIDRs restricts tcp clients to the given source networks or addresses.
+	AllowedSourceCIDRs []string
+	// AllowedPeerUids restricts clients to processes owned by the given users, e.g. os.Getuid().
+	// Only unix socket and loopback tcp clients can be verified, other clients are rejected. Linux only.
+	AllowedPeerUids []int
+	// UnixSocketMode sets the permission bits of the LocalUnixSocket file, only its owner can connect when not set.
+	UnixSocketMode os.FileMode
+	// UnixSocketOwner and UnixSocketGroup set the ownership of the LocalUnixSocket file, by name or numeric id.
+	UnixSocketOwner string
+	UnixSocketGroup string
+	// ConnectRetryAttempts is the number of times input is sent again after the agent failed to connect
+	// to the destination port, before the local connection is closed. Not used by multiplexed sessions.
+	ConnectRetryAttempts int
+	// ConnectRetryDelay is the wait before a retry, config.ConnectToPortRetryDelay when not set.
+	ConnectRetryDelay time.Duration
+	// DisableMultiplexing forwards one client connection at a time even when the agent supports multiplexing.
+	DisableMultiplexing bool
+	// ClientMode selects how clients arriving while another one is served are handled when the session
+	// is not multiplexed, ClientModeQueue (default) or ClientModeSession.
+	ClientMode string
+	// ClientQueueTimeout is how long a queued client waits before it is closed, DefaultClientQueueTimeout when not set.
+	ClientQueueTimeout time.Duration
+	// StreamLingerTimeout is how long a multiplexed stream stays open without traffic after one side closed its write side,
+	// DefaultStreamLingerTimeout when not set. A negative value closes the connection on the first EOF.
+	StreamLingerTimeout time.Duration
+	// StreamIdleTimeout closes multiplexed streams without traffic in either direction for that long, disabled when not set.
+	StreamIdleTimeout time.Duration
+	// Smux tunes the multiplexing protocol of the session.
+	Smux SmuxOptions
+	// Listener is a pre-opened listener used instead of opening one, e.g. from GetInheritedListener.
+	Listener net.Listener
+	// EventsFd and EventsFile select where JSON readiness and connection events are written, see PortEvent.
+	EventsFd   int
+	EventsFile string
+	// OnListenerReady is called once the local listener is ready to accept connections.
+	OnListenerReady func(listenerInfo ListenerInfo)
+	// OnStreamOpenerReady is called once a multiplexed port session can carry streams.
+	// When set, no local listener is opened and connections are only created through the opener.
+	OnStreamOpenerReady func(opener StreamOpener)
+}
+
+// StreamOpener opens new connections to the remote port of a multiplexed port session.
+type StreamOpener interface {
+	OpenStream() (net.Conn, error)
+}
+
+// ListenerInfo describes the local listener of a port session.
+type ListenerInfo struct {
+	SessionId  string
+	Network    string
+	Address    string
+	PortNumber string
+}
+
 func init() {
 	session.Register(&PortSession{})
 }
@@ -62,16 +132,29 @@ func (s *PortSession) Initialize(sessionVar *session.Session) {
 	if err := jsonutil.Remarshal(s.SessionProperties, &s.portParameters); err != nil {
 		log.Errorf("Invalid format: %v", err)
 	}
+	s.portOptions = getPortOptions(s.PluginOptions)
+	if s.portOptions.LocalHost != "" {
+		s.portParameters.LocalHost = s.portOptions.LocalHost
+	}
 
-	if s.portParameters.Type == LocalPortForwardingType {
+	if s.portParameters.Type == LocalPortForwardingType && !s.isMultiplexingSupported() {
+		s.portSessionType = &BasicPortForwarding{
+			sessionId:      s.SessionId,
+			portParameters: s.portParameters,
+			portOptions:    s.portOptions,
+			session:        s.Session,
+		}
+	} else if s.portParameters.Type == LocalPortForwardingType {
 		s.portSessionType = &MuxPortForwarding{
 			sessionId:      s.SessionId,
 			portParameters: s.portParameters,
+			portOptions:    s.portOptions,
 			session:        s.Session,
 		}
 	} else {
 		s.portSessionType = &StandardStreamForwarding{
 			portParameters: s.portParameters,
+			portOptions:    s.portOptions,
 			session:        s.Session,
 		}
 	}
@@ -102,6 +185,11 @@ func (s *PortSession) Stop() {
 
 // StartSession redirects inputStream/outputStream data to datachannel.
 func (s *PortSession) SetSessionHandlers() (err error) {
+	// streams can only be opened over a multiplexed session, OnStreamOpenerReady would never be called
+	if _, multiplexed := s.portSessionType.(*MuxPortForwarding); s.portOptions.OnStreamOpenerReady != nil && !multiplexed {
+		return fmt.Errorf("session %s cannot open streams, SSM Agent on instance[%s] does not support multiplexing", s.SessionId, s.TargetId)
+	}
+
 	if err = s.portSessionType.InitializeStreams(s.DataChannel.GetAgentVersion()); err != nil {
 		return err
 	}
@@ -122,3 +210,65 @@ func (s *PortSession) ProcessStreamMessagePayload(outputMessage message.ClientMe
 	err = s.portSessionType.WriteStream(outputMessage)
 	return true, err
 }
+
+// isMultiplexingSupported returns true if client connections can be multiplexed over the session
+func (s *PortSession) isMultiplexingSupported() bool {
+	if s.portOptions.DisableMultiplexing {
+		return false
+	}
+	if !version.DoesAgentSupportTCPMultiplexing(s.DataChannel.GetAgentVersion()) {
+		log.Warnf("SSM Agent on instance[%s] does not support multiplexing, only one connection is forwarded at a time.", s.TargetId)
+		return false
+	}
+	return true
+}
+
+// getPortOptions returns the port options set on the session, if any.
+func getPortOptions(pluginOptions interface{}) PortOptions {
+	switch portOptions := pluginOptions.(type) {
+	case PortOptions:
+		return portOptions
+	case *PortOptions:
+		if portOptions != nil {
+			return *portOptions
+		}
+	}
+	return PortOptions{}
+}
+
+// notifyListenerReady reports a ready local listener to the OnListenerReady handler.
+func (o PortOptions) notifyListenerReady(sessionId string, listener net.Listener, portParameters PortParameters) {
+	if o.OnListenerReady == nil {
+		return
+	}
+	o.OnListenerReady(ListenerInfo{
+		SessionId:  sessionId,
+		Network:    listener.Addr().Network(),
+		Address:    listener.Addr().String(),
+		PortNumber: portParameters.PortNumber,
+	})
+}
+
+// getLocalAddress returns the address the local tcp listener binds to, IPv6 hosts may be given with or without brackets.
+func getLocalAddress(portParameters PortParameters, portNumber string) string {
+	localHost := strings.Trim(portParameters.LocalHost, "[]")
+	if localHost == "" {
+		localHost = DefaultLocalHost
+	}
+	return net.JoinHostPort(localHost, portNumber)
+}
+
+// warnIfNotLoopback prints a warning when the listener is reachable from outside this machine.
+func warnIfNotLoopback(listener net.Listener) {
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+		log.Warnf("Listening on non-loopback address %s, the forwarded port is reachable from other hosts.", tcpAddr)
+	}
+}
+
+// getInheritedListenerMessage describes a pre-opened listener and records its port in the port parameters.
+func getInheritedListenerMessage(listener net.Listener, portParameters *PortParameters, sessionId string) string {
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+		portParameters.LocalPortNumber = strconv.Itoa(tcpAddr.Port)
+	}
+	return fmt.Sprintf("Inherited listener %s opened for sessionId %s.", listener.Addr(), sessionId)
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/session"
+)
+
+// errSessionPoolClosed is returned when a session is acquired after the pool was closed
+var errSessionPoolClosed = errors.New("port sessions are closed")
+
+// sessionPool runs multiplexed port sessions on demand, one per target and remote address,
+// shared by all connections to that address and ended after idleTimeout without connections
+type sessionPool struct {
+	ssmEndpoint string
+	idleTimeout time.Duration
+	sessions    map[string]*pooledSession
+	closed      chan struct{}
+	closeOnce   sync.Once
+	lock        sync.Mutex
+}
+
+// pooledSession is a port session to a single remote host and port.
+// It is added to the pool before the session is started, ready is closed once streams can be opened
+// and done once the session has ended or could not be started.
+type pooledSession struct {
+	session     *session.Session
+	opener      StreamOpener
+	ready       chan struct{}
+	done        chan struct{}
+	err         error
+	activeConns int
+	lastUsed    time.Time
+}
+
+// newSessionPool creates a pool and starts ending idle sessions
+func newSessionPool(ssmEndpoint string, idleTimeout time.Duration) *sessionPool {
+	p := &sessionPool{
+		ssmEndpoint: ssmEndpoint,
+		idleTimeout: idleTimeout,
+		sessions:    make(map[string]*pooledSession),
+		closed:      make(chan struct{}),
+	}
+	go p.reapIdleSessions()
+	return p
+}
+
+// acquire returns the ready port session to address through target, starting one when none is running.
+// The session is started in the background, so that ctx only bounds the wait of this caller.
+// The session must be released once the caller is done with it.
+func (p *sessionPool) acquire(ctx context.Context, target string, address string) (*pooledSession, error) {
+	key := target + "/" + address
+	p.lock.Lock()
+	select {
+	case <-p.closed:
+		p.lock.Unlock()
+		return nil, errSessionPoolClosed
+	default:
+	}
+	s, found := p.sessions[key]
+	if found {
+		select {
+		case <-s.done:
+			delete(p.sessions, key)
+			found = false
+		default:
+		}
+	}
+	if !found {
+		s = &pooledSession{
+			ready:    make(chan struct{}),
+			done:     make(chan struct{}),
+			lastUsed: time.Now(),
+		}
+		p.sessions[key] = s
+	}
+	s.activeConns++
+	p.lock.Unlock()
+
+	if !found {
+		go p.startSession(s, key, target, address)
+	}
+
+	select {
+	case <-s.ready:
+		return s, nil
+	case <-s.done:
+		p.release(s)
+		if s.err != nil {
+			return nil, fmt.Errorf("session to %s through %s failed: %w", address, target, s.err)
+		}
+		return nil, fmt.Errorf("session to %s through %s ended before it was ready", address, target)
+	case <-ctx.Done():
+		p.release(s)
+		return nil, fmt.Errorf("session to %s through %s was not ready: %w", address, target, ctx.Err())
+	}
+}
+
+// release marks a user of the session as finished
+func (p *sessionPool) release(s *pooledSession) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s.activeConns--
+	s.lastUsed = time.Now()
+}
+
+// startSession starts the port session of s to the remote host and port, an empty host forwards to the target itself.
+// It runs until the session ended, when the pool was closed while the session was created it is terminated right away.
+func (p *sessionPool) startSession(s *pooledSession, key string, target string, address string) {
+	defer close(s.done)
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		s.err = err
+		return
+	}
+	documentName := config.RemoteHostPortForwardingDocumentName
+	parameters := map[string][]string{
+		"host":       {host},
+		"portNumber": {port},
+	}
+	if host == "" {
+		documentName = config.PortForwardingDocumentName
+		delete(parameters, "host")
+	}
+	portSession, err := session.CreateSession(target, documentName, parameters, p.ssmEndpoint)
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	p.lock.Lock()
+	s.session = portSession
+	closed := p.sessions[key] != s
+	p.lock.Unlock()
+	if closed {
+		s.err = errSessionPoolClosed
+		s.session.EndSession()
+		return
+	}
+
+	portSession.Supervised = true
+	portSession.PluginOptions = PortOptions{
+		OnStreamOpenerReady: func(opener StreamOpener) {
+			s.opener = opener
+			close(s.ready)
+		},
+	}
+
+	log.Infof("Starting session %s to %s through %s.", portSession.SessionId, address, target)
+	if s.err = portSession.Execute(); s.err != nil {
+		log.Errorf("Session %s to %s ended with error: %v", portSession.SessionId, address, s.err)
+	}
+	log.Infof("Session %s to %s closed.", portSession.SessionId, address)
+}
+
+// reapIdleSessions terminates sessions without users for longer than the idle timeout
+func (p *sessionPool) reapIdleSessions() {
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-time.After(p.idleTimeout / 2):
+		}
+
+		var idle []*pooledSession
+		p.lock.Lock()
+		for key, s := range p.sessions {
+			select {
+			case <-s.done:
+				delete(p.sessions, key)
+				continue
+			default:
+			}
+			if s.session != nil && s.activeConns == 0 && time.Since(s.lastUsed) > p.idleTimeout {
+				log.Infof("Ending idle session %s to %s.", s.session.SessionId, key)
+				idle = append(idle, s)
+				delete(p.sessions, key)
+			}
+		}
+		p.lock.Unlock()
+
+		for _, s := range idle {
+			s.session.EndSession()
+		}
+	}
+}
+
+// close terminates all sessions, further sessions cannot be acquired.
+// Sessions still being created are terminated by startSession once they are.
+func (p *sessionPool) close() {
+	p.closeOnce.Do(func() { close(p.closed) })
+
+	var started []*pooledSession
+	p.lock.Lock()
+	for key, s := range p.sessions {
+		if s.session != nil {
+			started = append(started, s)
+		}
+		delete(p.sessions, key)
+	}
+	p.lock.Unlock()
+
+	for _, s := range started {
+		s.session.EndSession()
+	}
+}
+
+// openStream opens a stream to the remote port of the session
+func (s *pooledSession) openStream() (net.Conn, error) {
+	stream, err := s.opener.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open stream in session %s: %w", s.session.SessionId, err)
+	}
+	return stream, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/version"
+	"github.com/xtaci/smux"
+)
+
+// SmuxOptions tune the multiplexing protocol of a port session, zero values keep the defaults of smux.DefaultConfig.
+type SmuxOptions struct {
+	// Version is the smux protocol version. Version 2 adds per-stream flow control,
+	// the SSM Agent must be configured for it as well, otherwise the session fails.
+	Version int
+	// MaxReceiveBuffer is the receive buffer shared by all streams of the session, in bytes.
+	MaxReceiveBuffer int
+	// MaxStreamBuffer is the receive window of a single stream, in bytes. Only enforced by version 2.
+	MaxStreamBuffer int
+	// MaxFrameSize is the largest frame sent to the agent, in bytes, at most 65535.
+	MaxFrameSize int
+	// KeepAliveInterval is how often keepalives are sent, a negative value disables them.
+	// By default keepalives are only sent to agents that close sessions without them.
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout closes the session when nothing was received from the agent for that long.
+	KeepAliveTimeout time.Duration
+}
+
+// getSmuxConfig builds the smux client configuration from the options and the agent version reported in the handshake
+func getSmuxConfig(agentVersion string, smuxOptions SmuxOptions) (*smux.Config, error) {
+	smuxConfig := smux.DefaultConfig()
+	if smuxOptions.Version != 0 {
+		smuxConfig.Version = smuxOptions.Version
+	}
+	if smuxOptions.MaxReceiveBuffer != 0 {
+		smuxConfig.MaxReceiveBuffer = smuxOptions.MaxReceiveBuffer
+	}
+	if smuxOptions.MaxStreamBuffer != 0 {
+		smuxConfig.MaxStreamBuffer = smuxOptions.MaxStreamBuffer
+	}
+	if smuxOptions.MaxFrameSize != 0 {
+		smuxConfig.MaxFrameSize = smuxOptions.MaxFrameSize
+	}
+	if smuxOptions.KeepAliveTimeout != 0 {
+		smuxConfig.KeepAliveTimeout = smuxOptions.KeepAliveTimeout
+	}
+
+	keepAliveRequired := !version.DoesAgentSupportDisableSmuxKeepAlive(agentVersion)
+	switch {
+	case smuxOptions.KeepAliveInterval > 0:
+		smuxConfig.KeepAliveInterval = smuxOptions.KeepAliveInterval
+	case smuxOptions.KeepAliveInterval < 0 && keepAliveRequired:
+		log.Warnf("SSM Agent %s closes sessions without keepalives, keeping smux keepalives enabled.", agentVersion)
+	case smuxOptions.KeepAliveInterval < 0 || !keepAliveRequired:
+		smuxConfig.KeepAliveDisabled = true
+	}
+
+	if smuxConfig.Version != 1 {
+		log.Warnf("Using smux protocol version %d, the SSM Agent %s must be configured for the same version.", smuxConfig.Version, agentVersion)
+	} else if smuxOptions.MaxStreamBuffer != 0 {
+		log.Warnf("Stream receive buffer of %d bytes is only enforced by smux protocol version 2.", smuxOptions.MaxStreamBuffer)
+	}
+	if err := smux.VerifyConfig(smuxConfig); err != nil {
+		return nil, fmt.Errorf("invalid smux configuration: %v", err)
+	}
+	return smuxConfig, nil
+}
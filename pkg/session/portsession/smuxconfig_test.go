@@ -0,0 +1,91 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+func TestGetSmuxConfig(t *testing.T) {
+	// agents up to 3.1.1511.0 close multiplexed sessions without keepalives
+	const oldAgent, newAgent = "3.1.1511.0", "3.2.0.0"
+	defaults := smux.DefaultConfig()
+	tests := []struct {
+		name              string
+		agentVersion      string
+		options           SmuxOptions
+		keepAliveDisabled bool
+		keepAliveInterval time.Duration
+		wantErr           bool
+	}{
+		{name: "keepalives for old agents", agentVersion: oldAgent, keepAliveInterval: defaults.KeepAliveInterval},
+		{name: "no keepalives for new agents", agentVersion: newAgent, keepAliveDisabled: true, keepAliveInterval: defaults.KeepAliveInterval},
+		{name: "unknown agent version keeps keepalives", agentVersion: "", keepAliveInterval: defaults.KeepAliveInterval},
+		{name: "explicit interval", agentVersion: newAgent, options: SmuxOptions{KeepAliveInterval: 3 * time.Second},
+			keepAliveInterval: 3 * time.Second},
+		{name: "disabled for new agents", agentVersion: newAgent, options: SmuxOptions{KeepAliveInterval: -1},
+			keepAliveDisabled: true, keepAliveInterval: defaults.KeepAliveInterval},
+		{name: "cannot be disabled for old agents", agentVersion: oldAgent, options: SmuxOptions{KeepAliveInterval: -1},
+			keepAliveInterval: defaults.KeepAliveInterval},
+		{name: "frame size too large", agentVersion: newAgent, options: SmuxOptions{MaxFrameSize: 70000}, wantErr: true},
+		{name: "timeout shorter than interval", agentVersion: oldAgent,
+			options: SmuxOptions{KeepAliveInterval: time.Minute, KeepAliveTimeout: time.Second}, wantErr: true},
+	}
+	for _, test := range tests {
+		smuxConfig, err := getSmuxConfig(test.agentVersion, test.options)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: getSmuxConfig() succeeded, want error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: getSmuxConfig() failed: %v", test.name, err)
+		} else if smuxConfig.KeepAliveDisabled != test.keepAliveDisabled || smuxConfig.KeepAliveInterval != test.keepAliveInterval {
+			t.Errorf("%s: keepalive disabled %v interval %v, want disabled %v interval %v", test.name,
+				smuxConfig.KeepAliveDisabled, smuxConfig.KeepAliveInterval, test.keepAliveDisabled, test.keepAliveInterval)
+		}
+	}
+}
+
+func TestGetSmuxConfigOverrides(t *testing.T) {
+	options := SmuxOptions{
+		Version:          2,
+		MaxReceiveBuffer: 1 << 20,
+		MaxStreamBuffer:  1 << 16,
+		MaxFrameSize:     16384,
+		KeepAliveTimeout: time.Minute,
+	}
+	smuxConfig, err := getSmuxConfig("3.2.0.0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if smuxConfig.Version != 2 || smuxConfig.MaxReceiveBuffer != 1<<20 || smuxConfig.MaxStreamBuffer != 1<<16 ||
+		smuxConfig.MaxFrameSize != 16384 || smuxConfig.KeepAliveTimeout != time.Minute {
+		t.Errorf("getSmuxConfig() = %+v, want the options applied", smuxConfig)
+	}
+
+	defaults := smux.DefaultConfig()
+	if smuxConfig, err = getSmuxConfig("3.2.0.0", SmuxOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if smuxConfig.Version != defaults.Version || smuxConfig.MaxReceiveBuffer != defaults.MaxReceiveBuffer ||
+		smuxConfig.MaxFrameSize != defaults.MaxFrameSize || smuxConfig.KeepAliveTimeout != defaults.KeepAliveTimeout {
+		t.Errorf("getSmuxConfig() = %+v, want the smux defaults for zero options", smuxConfig)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+)
+
+const (
+	DefaultSocksIdleTimeout  = 5 * time.Minute
+	SocksSessionStartTimeout = 30 * time.Second
+	SocksHandshakeTimeout    = 10 * time.Second
+)
+
+// SOCKS5 protocol values, refer - https://www.rfc-editor.org/rfc/rfc1928
+const (
+	socksVersion5                 = 0x05
+	socksMethodNoAuth             = 0x00
+	socksMethodNoAcceptable       = 0xff
+	socksCommandConnect           = 0x01
+	socksAddressIPv4              = 0x01
+	socksAddressDomain            = 0x03
+	socksAddressIPv6              = 0x04
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyHostUnreachable     = 0x04
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+)
+
+// SocksProxy is a local SOCKS5 server that forwards every connection through a port session
+// to the requested remote host, similar to ssh -D
+type SocksProxy struct {
+	target   string
+	listener net.Listener
+	sessions *sessionPool
+}
+
+// socksRequestError is a failed SOCKS request together with the reply code sent to the client
+type socksRequestError struct {
+	reply byte
+	err   error
+}
+
+func (e *socksRequestError) Error() string {
+	return e.err.Error()
+}
+
+// StartSocksProxy starts a SOCKS5 server on listenAddress and blocks until a control signal is received.
+// Port sessions to the requested hosts are started on demand through target and ended after idleTimeout without connections.
+func StartSocksProxy(target, profile, ssmEndpoint, listenAddress string, idleTimeout time.Duration) (err error) {
+	sdkutil.SetProfile(profile)
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultSocksIdleTimeout
+	}
+
+	p := &SocksProxy{target: target}
+	if p.listener, err = net.Listen("tcp", listenAddress); err != nil {
+		return err
+	}
+	p.sessions = newSessionPool(ssmEndpoint, idleTimeout)
+	warnIfNotLoopback(p.listener)
+	log.Alwaysf("SOCKS5 proxy listening on %s for target %s.", p.listener.Addr(), target)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sessionutil.ControlSignals...)
+	go func() {
+		<-signals
+		log.Always("Terminate signal received, exiting.")
+		p.Stop()
+	}()
+
+	return p.serve()
+}
+
+// Stop closes the listener and terminates all port sessions
+func (p *SocksProxy) Stop() {
+	p.listener.Close()
+	p.sessions.close()
+}
+
+// serve accepts SOCKS clients until the listener is closed
+func (p *SocksProxy) serve() error {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.handleClient(conn)
+	}
+}
+
+// handleClient performs the SOCKS handshake and bridges the client to a stream of the matching port session
+func (p *SocksProxy) handleClient(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(SocksHandshakeTimeout))
+	address, err := socksHandshake(conn)
+	if err != nil {
+		log.Debugf("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		var requestErr *socksRequestError
+		if errors.As(err, &requestErr) {
+			writeSocksReply(conn, requestErr.reply)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), SocksSessionStartTimeout)
+	defer cancel()
+	s, err := p.sessions.acquire(ctx, p.target, address)
+	if err != nil {
+		log.Errorf("Unable to forward %s to %s: %v", conn.RemoteAddr(), address, err)
+		writeSocksReply(conn, socksReplyHostUnreachable)
+		return
+	}
+	defer p.sessions.release(s)
+
+	stream, err := s.openStream()
+	if err != nil {
+		log.Errorf("Unable to open stream to %s: %v", address, err)
+		writeSocksReply(conn, socksReplyGeneralFailure)
+		return
+	}
+	if err = writeSocksReply(conn, socksReplySucceeded); err != nil {
+		stream.Close()
+		return
+	}
+
+	log.Infof("Forwarding %s to %s through session %s", conn.RemoteAddr(), address, s.session.SessionId)
+	stats := newStreamTransfer(stream, conn, PortOptions{}).run()
+	log.Infof("Connection from %s to %s closed after %v, %d bytes sent, %d bytes received.",
+		conn.RemoteAddr(), address, stats.Duration.Round(time.Millisecond), stats.BytesSent, stats.BytesReceived)
+}
+
+// socksHandshake negotiates the authentication method and reads the CONNECT request, returning the requested host:port
+func socksHandshake(conn net.Conn) (address string, err error) {
+	// greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socksVersion5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	if _, err = conn.Write([]byte{socksVersion5, method}); err != nil {
+		return
+	}
+	if method == socksMethodNoAcceptable {
+		return "", errors.New("client does not support unauthenticated access")
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err = io.ReadFull(conn, request); err != nil {
+		return
+	}
+	if request[1] != socksCommandConnect {
+		return "", &socksRequestError{socksReplyCommandNotSupported, fmt.Errorf("unsupported SOCKS command %d", request[1])}
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case socksAddressDomain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		domain := make([]byte, length[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		return "", &socksRequestError{socksReplyAddressNotSupported, fmt.Errorf("unsupported SOCKS address type %d", request[3])}
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSocksReply sends a reply with an unspecified bind address
+func writeSocksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion5, reply, 0x00, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
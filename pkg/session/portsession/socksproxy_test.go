@@ -0,0 +1,131 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// socksTestConn replays the bytes sent by a client and records the bytes written to it
+type socksTestConn struct {
+	net.Conn
+	input  *bytes.Reader
+	output bytes.Buffer
+}
+
+func (c *socksTestConn) Read(b []byte) (int, error) {
+	return c.input.Read(b)
+}
+
+func (c *socksTestConn) Write(b []byte) (int, error) {
+	return c.output.Write(b)
+}
+
+func TestSocksHandshake(t *testing.T) {
+	greeting := []byte{socksVersion5, 1, socksMethodNoAuth}
+	accepted := []byte{socksVersion5, socksMethodNoAuth}
+	tests := []struct {
+		name    string
+		input   []byte
+		address string
+		written []byte
+		wantErr bool
+		// reply is the reply code of a socksRequestError, zero for other errors
+		reply byte
+	}{
+		{
+			name:    "ipv4",
+			input:   append(greeting, socksVersion5, socksCommandConnect, 0, socksAddressIPv4, 10, 0, 0, 1, 0x1f, 0x90),
+			address: "10.0.0.1:8080",
+			written: accepted,
+		},
+		{
+			name: "ipv6",
+			input: append(greeting, socksVersion5, socksCommandConnect, 0, socksAddressIPv6,
+				0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80),
+			address: "[fd00::1]:80",
+			written: accepted,
+		},
+		{
+			name:    "domain",
+			input:   append(greeting, socksVersion5, socksCommandConnect, 0, socksAddressDomain, 7, 'd', 'b', '.', 't', 'e', 's', 't', 0x15, 0x38),
+			address: "db.test:5432",
+			written: accepted,
+		},
+		{
+			name:    "no auth among several methods",
+			input:   []byte{socksVersion5, 3, 0x02, 0x01, socksMethodNoAuth, socksVersion5, socksCommandConnect, 0, socksAddressIPv4, 127, 0, 0, 1, 0, 22},
+			address: "127.0.0.1:22",
+			written: accepted,
+		},
+		{
+			name:    "socks4",
+			input:   []byte{0x04, socksCommandConnect, 0, 80, 10, 0, 0, 1, 0},
+			wantErr: true,
+		},
+		{
+			name:    "authentication required",
+			input:   []byte{socksVersion5, 1, 0x02},
+			written: []byte{socksVersion5, socksMethodNoAcceptable},
+			wantErr: true,
+		},
+		{
+			name:    "bind",
+			input:   append(greeting, socksVersion5, 0x02, 0, socksAddressIPv4, 10, 0, 0, 1, 0, 80),
+			written: accepted,
+			wantErr: true,
+			reply:   socksReplyCommandNotSupported,
+		},
+		{
+			name:    "unknown address type",
+			input:   append(greeting, socksVersion5, socksCommandConnect, 0, 0x05, 0, 80),
+			written: accepted,
+			wantErr: true,
+			reply:   socksReplyAddressNotSupported,
+		},
+		{
+			name:    "truncated request",
+			input:   append(greeting, socksVersion5, socksCommandConnect, 0, socksAddressIPv4, 10, 0),
+			written: accepted,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		conn := &socksTestConn{input: bytes.NewReader(test.input)}
+		address, err := socksHandshake(conn)
+		if !bytes.Equal(conn.output.Bytes(), test.written) {
+			t.Errorf("%s: wrote %v, want %v", test.name, conn.output.Bytes(), test.written)
+		}
+		if !test.wantErr {
+			if err != nil {
+				t.Errorf("%s: handshake failed: %v", test.name, err)
+			} else if address != test.address {
+				t.Errorf("%s: address %q, want %q", test.name, address, test.address)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: handshake returned %q, want error", test.name, address)
+			continue
+		}
+		var requestErr *socksRequestError
+		if errors.As(err, &requestErr) != (test.reply != 0) || test.reply != 0 && requestErr.reply != test.reply {
+			t.Errorf("%s: error %v, want reply %d", test.name, err, test.reply)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package portsession
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"os/signal"
@@ -28,10 +29,13 @@ import (
 )
 
 type StandardStreamForwarding struct {
-	inputStream    *os.File
-	outputStream   *os.File
-	portParameters PortParameters
-	session        session.Session
+	inputStream         *os.File
+	outputStream        *os.File
+	portParameters      PortParameters
+	portOptions         PortOptions
+	retry               *connectRetry
+	connectToPortFailed bool
+	session             session.Session
 }
 
 // IsStreamNotSet checks if streams are not set
@@ -48,6 +52,7 @@ func (p *StandardStreamForwarding) Stop() {
 // InitializeStreams initializes the streams with its file descriptors
 func (p *StandardStreamForwarding) InitializeStreams(agentVersion string) (err error) {
 	p.handleControlSignals()
+	p.retry = newConnectRetry(p.portOptions)
 	p.inputStream = os.Stdin
 	p.outputStream = os.Stdout
 	return
@@ -55,6 +60,9 @@ func (p *StandardStreamForwarding) InitializeStreams(agentVersion string) (err e
 
 // handleControlSignals handles terminate signals
 func (p *StandardStreamForwarding) handleControlSignals() {
+	if p.session.Supervised {
+		return
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, sessionutil.ControlSignals...)
 	go func() {
@@ -80,6 +88,7 @@ func (p *StandardStreamForwarding) ReadStream() (err error) {
 			log.Errorf("Failed to send packet: %v", err)
 			return err
 		}
+		p.retry.recordInput(msg[:numBytes])
 		// Sleep to process more data
 		time.Sleep(time.Millisecond)
 	}
@@ -87,13 +96,39 @@ func (p *StandardStreamForwarding) ReadStream() (err error) {
 
 // WriteStream writes data to output stream
 func (p *StandardStreamForwarding) WriteStream(outputMessage message.ClientMessage) error {
+	if message.PayloadType(outputMessage.PayloadType) == message.Flag {
+		if flag, err := getFlag(outputMessage.Payload); err != nil {
+			log.Debugf("Ignoring invalid flag payload: %v", err)
+		} else if flag == message.ConnectToPortError {
+			p.handleConnectToPortError()
+		}
+		return nil
+	}
+
+	p.retry.markConnected()
 	_, err := p.outputStream.Write(outputMessage.Payload)
 	return err
 }
 
+// handleConnectToPortError sends the unanswered input again, or ends the session when no retry is left
+func (p *StandardStreamForwarding) handleConnectToPortError() {
+	if p.retry.retry(p.session.DataChannel, p.portParameters.PortNumber) {
+		return
+	}
+
+	// closing the streams ends ReadStream, which reports the failure
+	p.connectToPortFailed = true
+	if err := p.session.DataChannel.SendFlag(message.TerminateSession); err != nil {
+		log.Errorf("Failed to send TerminateSession flag: %v", err)
+	}
+	p.Stop()
+}
+
 // handleReadError handles read error
 func (p *StandardStreamForwarding) handleReadError(err error) error {
-	if err == io.EOF {
+	if p.connectToPortFailed {
+		return fmt.Errorf("connection to destination port %s on instance[%s] failed, check SSM Agent logs", p.portParameters.PortNumber, p.session.TargetId)
+	} else if err == io.EOF {
 		log.Infof("Session to instance[%s] on port[%s] was closed.", p.session.TargetId, p.portParameters.PortNumber)
 		return nil
 	} else {
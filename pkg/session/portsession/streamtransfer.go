@@ -0,0 +1,189 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+)
+
+const (
+	DefaultStreamLingerTimeout = 5 * time.Second
+	streamCopyBufferSize       = 32 * 1024
+)
+
+// transferStats are the bytes forwarded on a client connection
+type transferStats struct {
+	// BytesSent is the number of bytes read from the client and sent to the remote port
+	BytesSent int64
+	// BytesReceived is the number of bytes received from the remote port and written to the client
+	BytesReceived int64
+	Duration      time.Duration
+}
+
+// closeWriter is implemented by connections supporting half-close, e.g. *net.TCPConn and *net.UnixConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// streamTransfer forwards data between a client connection and a mux stream.
+//
+// A half-close of the client is not propagated to the remote port. smux v1 has no half-close,
+// a FIN ends both directions of a stream and writes after it fail, and the agent forwards everything
+// it reads from a stream to the remote port, so an in-band marker would reach the remote port as data.
+// Protocols where the server waits for EOF before it answers, such as "nc -N", do not work.
+//
+// When the client closes its write side, the stream is kept open to deliver the remaining response
+// until the remote side closes it or no data arrives within the linger timeout. A client that closed
+// the connection fully cannot be told apart from one that half-closed it, so it lingers the same way
+// until a write to it fails. Clients that cannot half-close end the transfer right away.
+// When the remote side closes the stream, the client connection is half-closed so that the client
+// reads all data followed by EOF.
+type streamTransfer struct {
+	stream        net.Conn
+	conn          net.Conn
+	lingerTimeout time.Duration
+	idleTimeout   time.Duration
+	sent          atomic.Int64
+	received      atomic.Int64
+	idleTimer     atomic.Pointer[time.Timer]
+	lingerTimer   atomic.Pointer[time.Timer]
+	lingerOnce    sync.Once
+	closeOnce     sync.Once
+}
+
+// newStreamTransfer creates a transfer using the stream timeouts of the port options.
+// A zero linger timeout uses DefaultStreamLingerTimeout, a negative one closes both ends on the first EOF.
+// A zero idle timeout keeps idle streams open.
+func newStreamTransfer(stream net.Conn, conn net.Conn, portOptions PortOptions) *streamTransfer {
+	lingerTimeout := portOptions.StreamLingerTimeout
+	if lingerTimeout == 0 {
+		lingerTimeout = DefaultStreamLingerTimeout
+	}
+	return &streamTransfer{
+		stream:        stream,
+		conn:          conn,
+		lingerTimeout: lingerTimeout,
+		idleTimeout:   portOptions.StreamIdleTimeout,
+	}
+}
+
+// run forwards data in both directions until both ends are closed and returns the transferred bytes
+func (t *streamTransfer) run() transferStats {
+	started := time.Now()
+	if t.idleTimeout > 0 {
+		t.idleTimer.Store(time.AfterFunc(t.idleTimeout, func() {
+			log.Debugf("Stream from %s was idle for %v, closing it.", t.conn.RemoteAddr(), t.idleTimeout)
+			t.close()
+		}))
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(2)
+
+	go func() {
+		defer wait.Done()
+		if err := t.copy(t.stream, t.conn, &t.sent); err != nil {
+			t.close()
+			return
+		}
+		if _, ok := t.conn.(closeWriter); !ok {
+			// the client cannot half-close, so it has closed the connection
+			t.close()
+			return
+		}
+		log.Debugf("Client %s closed its write side.", t.conn.RemoteAddr())
+		t.linger()
+	}()
+
+	go func() {
+		defer wait.Done()
+		if err := t.copy(t.conn, t.stream, &t.received); err != nil {
+			t.close()
+			return
+		}
+		if cw, ok := t.conn.(closeWriter); ok {
+			// the remote side is done, let the client read EOF
+			cw.CloseWrite()
+			t.linger()
+			return
+		}
+		t.close()
+	}()
+
+	wait.Wait()
+	t.close()
+	return transferStats{
+		BytesSent:     t.sent.Load(),
+		BytesReceived: t.received.Load(),
+		Duration:      time.Since(started),
+	}
+}
+
+// copy copies src to dst until src returns EOF, which is reported as a nil error
+func (t *streamTransfer) copy(dst io.Writer, src io.Reader, counter *atomic.Int64) error {
+	buf := make([]byte, streamCopyBufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if idleTimer := t.idleTimer.Load(); idleTimer != nil {
+				idleTimer.Reset(t.idleTimeout)
+			}
+			if lingerTimer := t.lingerTimer.Load(); lingerTimer != nil {
+				lingerTimer.Reset(t.lingerTimeout)
+			}
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			counter.Add(int64(n))
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// linger closes both ends once no data was forwarded within the linger timeout after one side finished
+func (t *streamTransfer) linger() {
+	if t.lingerTimeout < 0 {
+		t.close()
+		return
+	}
+	t.lingerOnce.Do(func() {
+		t.lingerTimer.Store(time.AfterFunc(t.lingerTimeout, t.close))
+	})
+}
+
+// close closes the stream and the client connection
+func (t *streamTransfer) close() {
+	t.closeOnce.Do(func() {
+		if idleTimer := t.idleTimer.Load(); idleTimer != nil {
+			idleTimer.Stop()
+		}
+		if lingerTimer := t.lingerTimer.Load(); lingerTimer != nil {
+			lingerTimer.Stop()
+		}
+		t.stream.Close()
+		t.conn.Close()
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package portsession starts port session.
+package portsession
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpConnPair returns both ends of a loopback TCP connection, the accepted end is the client connection of a transfer
+func tcpConnPair(t *testing.T) (client *net.TCPConn, accepted *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+// runTransfer runs the transfer in the background and returns its stats once it ends
+func runTransfer(transfer *streamTransfer) <-chan transferStats {
+	done := make(chan transferStats, 1)
+	go func() { done <- transfer.run() }()
+	return done
+}
+
+func waitTransfer(t *testing.T, done <-chan transferStats) transferStats {
+	select {
+	case stats := <-done:
+		return stats
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer did not end")
+	}
+	return transferStats{}
+}
+
+func TestStreamTransferRemoteClose(t *testing.T) {
+	client, conn := tcpConnPair(t)
+	stream, remote := net.Pipe()
+	done := runTransfer(newStreamTransfer(stream, conn, PortOptions{StreamLingerTimeout: 50 * time.Millisecond}))
+
+	go func() {
+		request := make([]byte, 4)
+		io.ReadFull(remote, request)
+		remote.Write([]byte("response"))
+		remote.Close()
+	}()
+	client.Write([]byte("ping"))
+
+	// the client reads the whole response followed by EOF
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Errorf("client read %q, %v, want %q followed by EOF", response, err, "response")
+	}
+	client.Close()
+
+	if stats := waitTransfer(t, done); stats.BytesSent != 4 || stats.BytesReceived != 8 {
+		t.Errorf("transfer stats %+v, want 4 bytes sent and 8 received", stats)
+	}
+}
+
+func TestStreamTransferClientHalfClose(t *testing.T) {
+	client, conn := tcpConnPair(t)
+	stream, remote := net.Pipe()
+	done := runTransfer(newStreamTransfer(stream, conn, PortOptions{StreamLingerTimeout: time.Minute}))
+
+	client.Write([]byte("query"))
+	client.CloseWrite()
+
+	request := make([]byte, 5)
+	if _, err := io.ReadFull(remote, request); err != nil {
+		t.Fatal(err)
+	}
+	// the stream stays open after the client closed its write side, so the response still arrives
+	if _, err := remote.Write([]byte("rows")); err != nil {
+		t.Fatalf("stream closed after client half-close: %v", err)
+	}
+	remote.Close()
+
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "rows" {
+		t.Errorf("client read %q, %v, want %q followed by EOF", response, err, "rows")
+	}
+	client.Close()
+	waitTransfer(t, done)
+}
+
+func TestStreamTransferLingerTimeout(t *testing.T) {
+	client, conn := tcpConnPair(t)
+	stream, remote := net.Pipe()
+	done := runTransfer(newStreamTransfer(stream, conn, PortOptions{StreamLingerTimeout: 50 * time.Millisecond}))
+
+	client.CloseWrite()
+	// the remote side never answers, so the transfer ends once the linger timeout passes
+	waitTransfer(t, done)
+	if _, err := remote.Write([]byte("late")); err == nil {
+		t.Error("stream still open after the linger timeout")
+	}
+}
+
+func TestStreamTransferClientWithoutHalfClose(t *testing.T) {
+	conn, client := net.Pipe()
+	stream, remote := net.Pipe()
+	done := runTransfer(newStreamTransfer(stream, conn, PortOptions{StreamLingerTimeout: time.Minute}))
+
+	// net.Pipe cannot half-close, so EOF from the client closes the stream right away
+	client.Close()
+	waitTransfer(t, done)
+	if _, err := remote.Write([]byte("late")); err == nil {
+		t.Error("stream still open after the client closed")
+	}
+}
+
+func TestStreamTransferIdleTimeout(t *testing.T) {
+	_, conn := tcpConnPair(t)
+	stream, _ := net.Pipe()
+	started := time.Now()
+	done := runTransfer(newStreamTransfer(stream, conn, PortOptions{StreamIdleTimeout: 50 * time.Millisecond}))
+
+	waitTransfer(t, done)
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Errorf("idle transfer ended after %v, before the idle timeout", elapsed)
+	}
+}
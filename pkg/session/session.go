@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"reflect"
 	"time"
 
 	"github.com/aws/session-manager-plugin/pkg/config"
@@ -25,10 +26,12 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/session-manager-plugin/pkg/datachannel"
+	"github.com/aws/session-manager-plugin/pkg/jsonutil"
 	"github.com/aws/session-manager-plugin/pkg/log"
 	"github.com/aws/session-manager-plugin/pkg/message"
 	"github.com/aws/session-manager-plugin/pkg/sdkutil"
 	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+	"github.com/aws/session-manager-plugin/pkg/websocketutil"
 	"github.com/twinj/uuid"
 )
 
@@ -75,11 +78,27 @@ type Session struct {
 	Endpoint              string
 	ClientId              string
 	TargetId              string
+	DocumentName          string
+	Parameters            map[string][]string
 	retryParams           retry.RepeatableExponentialRetryer
 	sdk                   *ssm.Client
 	SessionType           string
 	SessionProperties     interface{}
 	DisplayMode           sessionutil.DisplayMode
+	// LivenessTimeout overrides config.DefaultLivenessTimeout when set, a negative value disables liveness tracking.
+	LivenessTimeout time.Duration
+	// WebsocketOptions are applied to the data channel handshake, including reconnects.
+	WebsocketOptions websocketutil.WebsocketOptions
+	// PluginOptions are client side options interpreted by the session plugin, e.g. portsession.PortOptions.
+	PluginOptions interface{}
+	// Limits are client side limits by session type, e.g. config.ShellPluginName.
+	// The limits of the empty session type apply to session types without limits.
+	Limits map[string]SessionLimits
+	// Supervised is set when the session runs under a supervisor that owns signal handling and status output.
+	Supervised bool
+	// ResumeState resumes the session of a client process that ended from the state of its data channel,
+	// the data channel is opened through ResumeSessionHandler instead of with TokenValue.
+	ResumeState *datachannel.ResumeState
 }
 
 // startSession create the datachannel for session
@@ -90,8 +109,11 @@ var startSession = func(session *Session) error {
 // setSessionHandlersWithSessionType set session handlers based on session subtype
 var setSessionHandlersWithSessionType = func(session *Session) error {
 	// SessionType is set inside DataChannel
-	sessionSubType := SessionRegistry[session.SessionType]
+	// each session gets its own plugin instance so that several sessions can run in one process
+	registeredPlugin := SessionRegistry[session.SessionType]
+	sessionSubType := reflect.New(reflect.TypeOf(registeredPlugin).Elem()).Interface().(ISessionPlugin)
 	sessionSubType.Initialize(session)
+	enforceSessionLimits(session, sessionSubType.Stop)
 	return sessionSubType.SetSessionHandlers()
 }
 
@@ -139,6 +161,12 @@ func ValidateInputAndStartSession(response, profile, ssmEndpoint, parameters str
 	session.Endpoint = ssmEndpoint
 	session.ClientId = clientId
 	session.TargetId = target
+	if documentName, ok := startSessionRequest["DocumentName"].(string); ok {
+		session.DocumentName = documentName
+	}
+	if err = jsonutil.Remarshal(startSessionRequest["Parameters"], &session.Parameters); err != nil {
+		log.Debugf("Ignoring invalid session parameters: %v", err)
+	}
 	session.DataChannel = &datachannel.DataChannel{}
 
 	if err = startSession(&session); err != nil {
@@ -151,7 +179,9 @@ func ValidateInputAndStartSession(response, profile, ssmEndpoint, parameters str
 
 // Execute create data channel and start the session
 func (s *Session) Execute() (err error) {
-	log.Alwaysf("Starting session with SessionId: %s\n", s.SessionId)
+	if !s.Supervised {
+		log.Alwaysf("Starting session with SessionId: %s\n", s.SessionId)
+	}
 
 	// sets the display mode
 	s.DisplayMode = sessionutil.NewDisplayMode()
@@ -16,14 +16,17 @@ package session
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/datachannel"
 	"github.com/aws/session-manager-plugin/pkg/log"
 	"github.com/aws/session-manager-plugin/pkg/message"
 	"github.com/aws/session-manager-plugin/pkg/retry"
 	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/twinj/uuid"
 )
 
 // OpenDataChannel initializes datachannel
@@ -37,13 +40,27 @@ func (s *Session) OpenDataChannel() (err error) {
 
 	s.DataChannel.Initialize(s.ClientId, s.SessionId, s.TargetId, s.IsAwsCliUpgradeNeeded)
 	s.DataChannel.SetWebsocket(s.StreamUrl, s.TokenValue)
+	if s.LivenessTimeout != 0 {
+		s.DataChannel.GetWsChannel().SetLivenessTimeout(s.LivenessTimeout)
+	}
+	s.DataChannel.GetWsChannel().SetWebsocketOptions(s.WebsocketOptions)
 	s.DataChannel.GetWsChannel().SetOnMessage(
 		func(input []byte) {
 			s.DataChannel.OutputMessageHandler(s.Stop, s.SessionId, input)
 		})
 	s.DataChannel.RegisterOutputStreamHandler(s.ProcessFirstMessage, false)
 
-	if err = s.DataChannel.Open(); err != nil {
+	if s.ResumeState != nil {
+		if err = s.DataChannel.Resume(*s.ResumeState); err != nil {
+			return err
+		}
+		s.SessionType = s.ResumeState.SessionType
+		if err = s.ResumeSessionHandler(); err != nil {
+			return err
+		} else if s.TokenValue == "" {
+			return fmt.Errorf("session %s can no longer be resumed", s.SessionId)
+		}
+	} else if err = s.DataChannel.Open(); err != nil {
 		log.Errorf("Retrying connection for data channel id: %s failed with error: %s", s.SessionId, err)
 		s.retryParams.CallableFunc = func() (err error) { return s.DataChannel.Reconnect() }
 		if err = s.retryParams.Call(); err != nil {
@@ -147,3 +164,60 @@ func (s *Session) TerminateSession() error {
 	}
 	return nil
 }
+
+// EndSession stops processing the session and terminates it on the agent and through the TerminateSession API.
+// Sessions that have already ended are left alone.
+func (s *Session) EndSession() {
+	if s.DataChannel.IsSessionEnded() {
+		return
+	}
+	s.DataChannel.EndSession()
+	if s.DataChannel.GetWsChannel() != nil {
+		if err := s.DataChannel.SendFlag(message.TerminateSession); err != nil {
+			log.Debugf("Failed to send TerminateSession flag for session %s: %v", s.SessionId, err)
+		}
+	}
+	if err := s.TerminateSession(); err != nil {
+		log.Errorf("Failed to terminate session %s: %v", s.SessionId, err)
+	}
+}
+
+// CreateSession calls StartSession API and returns a session that is ready to Execute.
+// An empty documentName starts a shell session.
+func CreateSession(target string, documentName string, parameters map[string][]string, ssmEndpoint string) (*Session, error) {
+	var (
+		startSessionOutput *ssm.StartSessionOutput
+		err                error
+	)
+
+	sdk := ssm.NewFromConfig(sdkutil.GetSDKConfig())
+
+	startSessionInput := ssm.StartSessionInput{
+		Target:     &target,
+		Parameters: parameters,
+	}
+	// without a document the default shell session is started
+	if documentName != "" {
+		startSessionInput.DocumentName = &documentName
+	}
+
+	log.Debugf("Start Session input parameters: %v", startSessionInput)
+	if startSessionOutput, err = sdk.StartSession(context.TODO(), &startSessionInput); err != nil {
+		log.Errorf("Start Session failed: %v", err)
+		return nil, err
+	}
+
+	uuid.SwitchFormat(uuid.FormatCanonical)
+	return &Session{
+		SessionId:    *startSessionOutput.SessionId,
+		StreamUrl:    *startSessionOutput.StreamUrl,
+		TokenValue:   *startSessionOutput.TokenValue,
+		Endpoint:     ssmEndpoint,
+		ClientId:     uuid.NewV4().String(),
+		TargetId:     target,
+		DocumentName: documentName,
+		Parameters:   parameters,
+		DataChannel:  &datachannel.DataChannel{},
+		sdk:          sdk,
+	}, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package session starts the session.
+package session
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/log"
+)
+
+// SessionLimits are client side limits of a session, refer to Session.Limits.
+type SessionLimits struct {
+	// IdleTimeout ends the session after no input or output for this long, zero disables it.
+	// Keepalives of multiplexed port sessions count as activity unless disabled in portsession.SmuxOptions.
+	IdleTimeout time.Duration
+	// MaxDuration ends the session this long after it started, zero disables it.
+	MaxDuration time.Duration
+	// WarningPeriod is how long before a cutoff a warning is shown, config.DefaultSessionLimitWarning when zero.
+	WarningPeriod time.Duration
+}
+
+// getSessionLimits returns the limits for the session type, falling back to the limits of the empty session type
+func (s *Session) getSessionLimits() (limits SessionLimits, ok bool) {
+	if limits, ok = s.Limits[s.SessionType]; !ok {
+		limits, ok = s.Limits[""]
+	}
+	if limits.IdleTimeout <= 0 && limits.MaxDuration <= 0 {
+		return limits, false
+	}
+	if limits.WarningPeriod <= 0 {
+		limits.WarningPeriod = config.DefaultSessionLimitWarning
+	}
+	return limits, true
+}
+
+// enforceSessionLimits ends the session once it was idle for the idle timeout or ran for the maximum duration.
+var enforceSessionLimits = func(s *Session, stopHandler func()) {
+	limits, ok := s.getSessionLimits()
+	if !ok {
+		return
+	}
+	log.Debugf("Enforcing session limits for session %s: idle timeout %v, maximum duration %v.",
+		s.SessionId, limits.IdleTimeout, limits.MaxDuration)
+
+	check := &sessionLimitCheck{sessionId: s.SessionId, limits: limits, started: time.Now()}
+	go func() {
+		ticker := time.NewTicker(config.SessionLimitCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if s.DataChannel.IsSessionEnded() {
+				return
+			}
+			warnings, reason := check.check(time.Now(), s.DataChannel.GetLastActivity())
+			if reason != "" {
+				s.endSessionOnLimit(reason, stopHandler)
+				return
+			}
+			for _, warning := range warnings {
+				s.warnSessionLimit(warning)
+			}
+		}
+	}()
+}
+
+// sessionLimitCheck tracks the limits of a session between checks.
+// A warning is given once before each cutoff, the idle warning again after the session was active in between.
+type sessionLimitCheck struct {
+	sessionId      string
+	limits         SessionLimits
+	started        time.Time
+	idleWarned     bool
+	durationWarned bool
+}
+
+// check returns the warnings to show, or the reason to end the session when a limit is reached
+func (c *sessionLimitCheck) check(now time.Time, lastActivity time.Time) (warnings []string, reason string) {
+	if c.limits.MaxDuration > 0 {
+		remaining := c.limits.MaxDuration - now.Sub(c.started)
+		if remaining <= 0 {
+			return nil, fmt.Sprintf("Session %s reached the maximum duration of %v.", c.sessionId, c.limits.MaxDuration)
+		}
+		if remaining <= c.limits.WarningPeriod && !c.durationWarned {
+			c.durationWarned = true
+			warnings = append(warnings, fmt.Sprintf("Session %s will end in %v, the maximum duration is %v.",
+				c.sessionId, remaining.Round(time.Second), c.limits.MaxDuration))
+		}
+	}
+
+	if c.limits.IdleTimeout > 0 {
+		if lastActivity.Before(c.started) {
+			lastActivity = c.started
+		}
+		remaining := c.limits.IdleTimeout - now.Sub(lastActivity)
+		if remaining <= 0 {
+			return nil, fmt.Sprintf("Session %s was idle for %v.", c.sessionId, c.limits.IdleTimeout)
+		}
+		if remaining > c.limits.WarningPeriod {
+			c.idleWarned = false
+		} else if !c.idleWarned {
+			c.idleWarned = true
+			warnings = append(warnings, fmt.Sprintf("Session %s will end in %v without input or output.",
+				c.sessionId, remaining.Round(time.Second)))
+		}
+	}
+	return warnings, ""
+}
+
+// warnSessionLimit shows a warning about an upcoming cutoff
+func (s *Session) warnSessionLimit(warning string) {
+	log.Warnf("%s", warning)
+	if !s.Supervised {
+		// the terminal may be in raw mode, so carriage returns are needed
+		fmt.Fprintf(os.Stderr, "\r\n%s\r\n", warning)
+	}
+}
+
+// endSessionOnLimit terminates the session on the remote side and stops the session plugin
+func (s *Session) endSessionOnLimit(reason string, stopHandler func()) {
+	s.warnSessionLimit(reason + " Terminating session.")
+	s.EndSession()
+	s.DataChannel.Close()
+	stopHandler()
+}
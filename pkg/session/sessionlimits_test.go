@@ -0,0 +1,121 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package session starts the session.
+package session
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+)
+
+func TestGetSessionLimits(t *testing.T) {
+	shellLimits := SessionLimits{IdleTimeout: time.Hour, WarningPeriod: time.Minute}
+	defaultLimits := SessionLimits{MaxDuration: 8 * time.Hour, WarningPeriod: 5 * time.Minute}
+	tests := []struct {
+		name        string
+		sessionType string
+		limits      map[string]SessionLimits
+		want        SessionLimits
+		ok          bool
+	}{
+		{name: "no limits", sessionType: "Standard_Stream", ok: false},
+		{name: "limits of the session type", sessionType: "Standard_Stream",
+			limits: map[string]SessionLimits{"Standard_Stream": shellLimits, "": defaultLimits}, want: shellLimits, ok: true},
+		{name: "fallback to the empty session type", sessionType: "Port",
+			limits: map[string]SessionLimits{"Standard_Stream": shellLimits, "": defaultLimits}, want: defaultLimits, ok: true},
+		{name: "session type without limits disables the fallback", sessionType: "Port",
+			limits: map[string]SessionLimits{"Port": {}, "": defaultLimits}, ok: false},
+		{name: "default warning period", sessionType: "Port",
+			limits: map[string]SessionLimits{"": {IdleTimeout: time.Hour}},
+			want:   SessionLimits{IdleTimeout: time.Hour, WarningPeriod: config.DefaultSessionLimitWarning}, ok: true},
+	}
+	for _, test := range tests {
+		s := &Session{SessionType: test.sessionType, Limits: test.limits}
+		limits, ok := s.getSessionLimits()
+		if ok != test.ok || ok && limits != test.want {
+			t.Errorf("%s: getSessionLimits() = %+v, %v, want %+v, %v", test.name, limits, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestSessionLimitCheck(t *testing.T) {
+	type step struct {
+		// elapsed is the time since the session started, idle the time since the last activity
+		elapsed  time.Duration
+		idle     time.Duration
+		warnings []string
+		reason   string
+	}
+	tests := []struct {
+		name   string
+		limits SessionLimits
+		steps  []step
+	}{
+		{
+			name:   "maximum duration",
+			limits: SessionLimits{MaxDuration: 10 * time.Minute, WarningPeriod: time.Minute},
+			steps: []step{
+				{elapsed: 8 * time.Minute},
+				{elapsed: 9 * time.Minute, warnings: []string{"Session s-1 will end in 1m0s, the maximum duration is 10m0s."}},
+				{elapsed: 9*time.Minute + 30*time.Second},
+				{elapsed: 10 * time.Minute, reason: "Session s-1 reached the maximum duration of 10m0s."},
+			},
+		},
+		{
+			name:   "idle timeout warns again after activity",
+			limits: SessionLimits{IdleTimeout: 5 * time.Minute, WarningPeriod: time.Minute},
+			steps: []step{
+				{elapsed: 4*time.Minute + 30*time.Second, idle: 4*time.Minute + 30*time.Second,
+					warnings: []string{"Session s-1 will end in 30s without input or output."}},
+				{elapsed: 4*time.Minute + 40*time.Second, idle: 4*time.Minute + 40*time.Second},
+				{elapsed: 5 * time.Minute, idle: time.Second},
+				{elapsed: 9 * time.Minute, idle: 4*time.Minute + 10*time.Second,
+					warnings: []string{"Session s-1 will end in 50s without input or output."}},
+				{elapsed: 10 * time.Minute, idle: 5 * time.Minute, reason: "Session s-1 was idle for 5m0s."},
+			},
+		},
+		{
+			name:   "idle time counts from the start of the session",
+			limits: SessionLimits{IdleTimeout: 5 * time.Minute, WarningPeriod: time.Minute},
+			steps: []step{
+				{elapsed: 3 * time.Minute, idle: time.Hour},
+				{elapsed: 5 * time.Minute, idle: time.Hour, reason: "Session s-1 was idle for 5m0s."},
+			},
+		},
+		{
+			name:   "both warnings at once",
+			limits: SessionLimits{IdleTimeout: 5 * time.Minute, MaxDuration: 5 * time.Minute, WarningPeriod: time.Minute},
+			steps: []step{
+				{elapsed: 4 * time.Minute, idle: 4 * time.Minute, warnings: []string{
+					"Session s-1 will end in 1m0s, the maximum duration is 5m0s.",
+					"Session s-1 will end in 1m0s without input or output.",
+				}},
+			},
+		},
+	}
+	for _, test := range tests {
+		started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		check := &sessionLimitCheck{sessionId: "s-1", limits: test.limits, started: started}
+		for i, step := range test.steps {
+			now := started.Add(step.elapsed)
+			warnings, reason := check.check(now, now.Add(-step.idle))
+			if !reflect.DeepEqual(warnings, step.warnings) || reason != step.reason {
+				t.Errorf("%s: step %d: check() = %q, %q, want %q, %q", test.name, i, warnings, reason, step.warnings, step.reason)
+			}
+		}
+	}
+}
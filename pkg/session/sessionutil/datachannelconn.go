@@ -0,0 +1,159 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package sessionutil provides utility for sessions.
+package sessionutil
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/datachannel"
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/message"
+)
+
+// DataChannelConn is a connection over the data channel of a session.
+// Writes are sent to the agent as input stream messages, output received from the agent is queued for reads
+// by Push. Up to config.DataChannelReadBufferSize bytes are queued, pushing more blocks until they are read.
+type DataChannelConn struct {
+	dataChannel datachannel.IDataChannel
+	localAddr   net.Addr
+	remoteAddr  net.Addr
+	lock        sync.Mutex
+	cond        *sync.Cond
+	pending     [][]byte
+	pendingSize int
+	closed      bool
+	writeLock   sync.Mutex
+}
+
+// DataChannelAddr is an address reached over a data channel, such as a session id, a target or a remote host and port
+type DataChannelAddr string
+
+// Network returns the name of the network of data channel addresses
+func (a DataChannelAddr) Network() string {
+	return "ssm"
+}
+
+// String returns the address
+func (a DataChannelAddr) String() string {
+	return string(a)
+}
+
+// NewDataChannelConn creates a connection over the data channel of a session to a target
+func NewDataChannelConn(dataChannel datachannel.IDataChannel, sessionId string, targetId string) *DataChannelConn {
+	c := &DataChannelConn{
+		dataChannel: dataChannel,
+		localAddr:   DataChannelAddr(sessionId),
+		remoteAddr:  DataChannelAddr(targetId),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+// Read reads output received from the agent, it blocks until output is available or the connection is closed
+func (c *DataChannelConn) Read(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.pending) == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if len(c.pending) == 0 {
+		return 0, io.EOF
+	}
+
+	n = copy(b, c.pending[0])
+	if n == len(c.pending[0]) {
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+	} else {
+		c.pending[0] = c.pending[0][n:]
+	}
+	c.pendingSize -= n
+	c.cond.Broadcast()
+	return n, nil
+}
+
+// Write sends data to the agent in chunks of config.StreamDataPayloadSize
+func (c *DataChannelConn) Write(b []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	for n < len(b) {
+		if c.isClosed() || c.dataChannel.IsSessionEnded() {
+			return n, io.ErrClosedPipe
+		}
+		end := n + config.StreamDataPayloadSize
+		if end > len(b) {
+			end = len(b)
+		}
+		log.Tracef("Sending message of size %d on data channel.", end-n)
+		if err = c.dataChannel.SendInputDataMessage(message.Output, b[n:end]); err != nil {
+			log.Errorf("Failed to send packet on data channel: %v", err)
+			return n, err
+		}
+		n = end
+		// sleep to process more data
+		time.Sleep(time.Millisecond)
+	}
+	return n, nil
+}
+
+// Push queues output received from the agent for reading, it blocks while the queue is full
+func (c *DataChannelConn) Push(payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for c.pendingSize >= config.DataChannelReadBufferSize && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	c.pending = append(c.pending, payload)
+	c.pendingSize += len(payload)
+	c.cond.Broadcast()
+	return nil
+}
+
+// Close ends further writes and pushes, reads return the output queued before followed by EOF
+func (c *DataChannelConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+// LocalAddr returns the session id
+func (c *DataChannelConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr returns the target id
+func (c *DataChannelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// isClosed returns true once the connection is closed
+func (c *DataChannelConn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
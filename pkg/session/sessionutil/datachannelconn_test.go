@@ -0,0 +1,158 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package sessionutil provides utility for sessions.
+package sessionutil
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/datachannel"
+	"github.com/aws/session-manager-plugin/pkg/message"
+)
+
+// messageRecorder is a data channel that records the input messages sent on it
+type messageRecorder struct {
+	datachannel.IDataChannel
+	lock     sync.Mutex
+	messages []string
+	ended    bool
+}
+
+func (r *messageRecorder) SendInputDataMessage(payloadType message.PayloadType, inputData []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.messages = append(r.messages, string(inputData))
+	return nil
+}
+
+func (r *messageRecorder) IsSessionEnded() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ended
+}
+
+func TestDataChannelConnRead(t *testing.T) {
+	conn := NewDataChannelConn(&messageRecorder{}, "s-1", "i-1")
+	conn.Push([]byte("hello"))
+	conn.Push([]byte(" world"))
+	conn.Close()
+
+	var reads []string
+	buf := make([]byte, 3)
+	for {
+		n, err := conn.Read(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		reads = append(reads, string(buf[:n]))
+	}
+	// reads never span pushed payloads, and the output queued before Close is still read
+	if got := strings.Join(reads, "|"); got != "hel|lo| wo|rld" {
+		t.Errorf("reads %q, want %q", got, "hel|lo| wo|rld")
+	}
+	if err := conn.Push([]byte("late")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Push() after Close = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestDataChannelConnReadBlocksUntilPush(t *testing.T) {
+	conn := NewDataChannelConn(&messageRecorder{}, "s-1", "i-1")
+	read := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := conn.Read(buf)
+		read <- string(buf[:n])
+	}()
+	select {
+	case data := <-read:
+		t.Fatalf("Read() returned %q before anything was pushed", data)
+	case <-time.After(20 * time.Millisecond):
+	}
+	conn.Push([]byte("output"))
+	if data := <-read; data != "output" {
+		t.Errorf("Read() = %q, want %q", data, "output")
+	}
+}
+
+func TestDataChannelConnPushBlocksWhenFull(t *testing.T) {
+	conn := NewDataChannelConn(&messageRecorder{}, "s-1", "i-1")
+	if err := conn.Push(make([]byte, config.DataChannelReadBufferSize)); err != nil {
+		t.Fatal(err)
+	}
+	pushed := make(chan error)
+	go func() { pushed <- conn.Push([]byte("more")) }()
+	select {
+	case <-pushed:
+		t.Fatal("Push() into a full queue did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-pushed; err != nil {
+		t.Errorf("Push() after a read = %v", err)
+	}
+}
+
+func TestDataChannelConnPushUnblocksOnClose(t *testing.T) {
+	conn := NewDataChannelConn(&messageRecorder{}, "s-1", "i-1")
+	conn.Push(make([]byte, config.DataChannelReadBufferSize))
+	pushed := make(chan error)
+	go func() { pushed <- conn.Push([]byte("more")) }()
+	conn.Close()
+	if err := <-pushed; !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("blocked Push() after Close = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestDataChannelConnWrite(t *testing.T) {
+	recorder := &messageRecorder{}
+	conn := NewDataChannelConn(recorder, "s-1", "i-1")
+	data := strings.Repeat("x", config.StreamDataPayloadSize*2+10)
+	if n, err := conn.Write([]byte(data)); n != len(data) || err != nil {
+		t.Fatalf("Write() = %d, %v, want %d", n, err, len(data))
+	}
+	if len(recorder.messages) != 3 || len(recorder.messages[0]) != config.StreamDataPayloadSize ||
+		strings.Join(recorder.messages, "") != data {
+		t.Errorf("Write() sent %d messages, want the data in chunks of %d bytes", len(recorder.messages), config.StreamDataPayloadSize)
+	}
+
+	recorder.ended = true
+	if _, err := conn.Write([]byte("a")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Write() after the session ended = %v, want %v", err, io.ErrClosedPipe)
+	}
+	recorder.ended = false
+	conn.Close()
+	if _, err := conn.Write([]byte("a")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Write() after Close = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestDataChannelConnAddr(t *testing.T) {
+	conn := NewDataChannelConn(&messageRecorder{}, "s-1", "i-1")
+	if local := conn.LocalAddr(); local.Network() != "ssm" || local.String() != "s-1" {
+		t.Errorf("LocalAddr() = %s %s, want the session id", local.Network(), local)
+	}
+	if remote := conn.RemoteAddr(); remote.Network() != "ssm" || remote.String() != "i-1" {
+		t.Errorf("RemoteAddr() = %s %s, want the target id", remote.Network(), remote)
+	}
+}
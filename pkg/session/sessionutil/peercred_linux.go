@@ -0,0 +1,45 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License
+//go:build linux
+// +build linux
+
+// Package sessionutil provides utility for sessions.
+package sessionutil
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// GetUnixPeerUid returns the uid of the process connected to a unix socket using SO_PEERCRED
+func GetUnixPeerUid(conn *net.UnixConn) (uid int, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var (
+		ucred    *unix.Ucred
+		ucredErr error
+	)
+	if err = rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return -1, err
+	}
+	if ucredErr != nil {
+		return -1, ucredErr
+	}
+	return int(ucred.Uid), nil
+}
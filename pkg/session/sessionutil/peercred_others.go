@@ -0,0 +1,26 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+// Package sessionutil provides utility for sessions.
+package sessionutil
+
+import (
+	"net"
+)
+
+// GetUnixPeerUid is not supported on this platform
+func GetUnixPeerUid(conn *net.UnixConn) (int, error) {
+	return -1, ErrPeerUidUnsupported
+}
@@ -14,8 +14,33 @@
 // Package sessionutil provides utility for sessions.
 package sessionutil
 
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ErrPeerUidUnsupported is returned where the uid of the peer of a connection cannot be looked up
+var ErrPeerUidUnsupported = errors.New("peer uid lookup is not supported on this platform")
+
 func NewDisplayMode() DisplayMode {
 	displayMode := DisplayMode{}
 	displayMode.InitDisplayMode()
 	return displayMode
 }
+
+// IsStaleUnixSocket returns true when path is a unix socket that no process listens on anymore.
+// Sockets that cannot be connected to for other reasons, e.g. missing permissions, are not stale.
+func IsStaleUnixSocket(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
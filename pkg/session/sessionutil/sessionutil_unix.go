@@ -20,10 +20,15 @@ package sessionutil
 import (
 	"fmt"
 	"net"
+	"sync"
+	"syscall"
 
 	"github.com/aws/session-manager-plugin/pkg/message"
 )
 
+// umaskLock serializes changes of the process wide umask
+var umaskLock sync.Mutex
+
 type DisplayMode struct {
 }
 
@@ -35,7 +40,12 @@ func (d *DisplayMode) DisplayMessage(message message.ClientMessage) {
 	fmt.Print(string(message.Payload))
 }
 
-// NewListener starts a new socket listener on the address.
-func NewListener(address string) (net.Listener, error) {
-	return net.Listen("unix", address)
+// ListenUnixSocket opens a unix socket that only its owner can connect to until its mode is changed,
+// so that no other user can connect before the permissions of the socket are set.
+func ListenUnixSocket(path string) (net.Listener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	mask := syscall.Umask(0077)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
 }
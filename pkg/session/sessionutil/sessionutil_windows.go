@@ -74,13 +74,7 @@ func (d *DisplayMode) DisplayMessage(message message.ClientMessage) {
 	}
 }
 
-// NewListener starts a new socket listener on the address.
-// unix sockets are not supported in older windows versions, start tcp loopback server in such cases
-func NewListener(address string) (net.Listener, error) {
-	if listener, err := net.Listen("unix", address); err != nil {
-		log.Infof("Failed to open unix socket listener, %v. Starting TCP listener.", err)
-		return net.Listen("tcp", "localhost:0")
-	} else {
-		return listener, err
-	}
+// ListenUnixSocket opens a unix socket, its permissions are inherited from the directory it is created in.
+func ListenUnixSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
 }
@@ -0,0 +1,553 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/aws/session-manager-plugin/pkg/session"
+	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+	"golang.org/x/term"
+)
+
+// BroadcastLayout is how the output of the shells of a broadcast is displayed.
+type BroadcastLayout int
+
+const (
+	// BroadcastInterleaved prefixes every line of output with the target it came from
+	BroadcastInterleaved BroadcastLayout = iota
+	// BroadcastPanes displays output in sections labelled with the target, a new label is shown whenever the target changes
+	BroadcastPanes
+)
+
+// BroadcastFlushInterval is how long a partial line of output, e.g. a prompt, is held back before it is displayed
+const BroadcastFlushInterval = 200 * time.Millisecond
+
+// broadcast commands, typed on the command line opened with the escape sequence "~C"
+const (
+	broadcastSelect = "select"
+	broadcastList   = "list"
+	broadcastPrompt = "broadcast> "
+)
+
+// BroadcastOptions are options of StartBroadcast.
+type BroadcastOptions struct {
+	// Layout is how output is displayed, BroadcastInterleaved when not set.
+	Layout BroadcastLayout
+	// Selected are the targets that receive input initially, all targets when empty.
+	Selected []string
+	// Input is sent to the selected shells as it is read, stdin when not set.
+	// A terminal is switched to raw mode, so that keystrokes are sent as they are typed.
+	Input io.Reader
+	// Output receives the output of all shells, stdout when not set.
+	Output io.Writer
+}
+
+// broadcast fans input out to the shells of several targets and merges their output.
+type broadcast struct {
+	options BroadcastOptions
+	width   int
+	// raw is set when the input is a terminal in raw mode, whose output needs carriage returns
+	raw bool
+	// commandLine is the command being typed after "~C", nil while keystrokes go to the shells
+	commandLine []byte
+
+	lock    sync.Mutex
+	targets map[string]bool
+	shells  map[string]*broadcastShell
+	// selected are the targets receiving input, nil for all targets
+	selected map[string]bool
+	// lastLabel is the target of the last output displayed, for BroadcastPanes
+	lastLabel string
+	done      chan struct{}
+	stopOnce  sync.Once
+	// outputLock serializes all writes to the output, it is taken after lock where both are held
+	outputLock sync.Mutex
+}
+
+// broadcastShell is the shell of one target of a broadcast
+type broadcastShell struct {
+	target  string
+	conn    io.ReadWriter
+	partial []byte
+	flush   *time.Timer
+}
+
+// StartBroadcast opens one shell session per target and sends every keystroke to the selected shells,
+// similar to synchronize-panes of tmux. Escape sequences are recognized after a newline as in a single session:
+// "~." terminates all sessions, "~C" opens the command line of the broadcast and "~?" lists them.
+// It returns once the input ended, the broadcast was terminated or all sessions have ended.
+// Input files are not read after it returned, except for a read of the Windows console, see newCancelableReader.
+func StartBroadcast(targets []string, profile, ssmEndpoint string, options BroadcastOptions) error {
+	if len(targets) == 0 {
+		return errors.New("no targets to broadcast to")
+	}
+	if options.Input == nil {
+		options.Input = os.Stdin
+	}
+	if options.Output == nil {
+		options.Output = os.Stdout
+	}
+	sdkutil.SetProfile(profile)
+
+	b := &broadcast{
+		options: options,
+		targets: make(map[string]bool),
+		shells:  make(map[string]*broadcastShell),
+		done:    make(chan struct{}),
+	}
+	if file, ok := options.Input.(*os.File); ok && term.IsTerminal(int(file.Fd())) {
+		state, err := term.MakeRaw(int(file.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(file.Fd()), state)
+		b.raw = true
+		b.options.Output = crlfWriter{options.Output}
+	}
+	if file, ok := options.Input.(*os.File); ok {
+		b.options.Input = newCancelableReader(file, b.done)
+	}
+	for _, target := range targets {
+		b.targets[target] = true
+		if len(target) > b.width {
+			b.width = len(target)
+		}
+	}
+	if err := b.selectTargets(options.Selected); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	started := make(chan string, len(targets))
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			if err := b.runShell(target, ssmEndpoint, started); err != nil {
+				b.notice(target, fmt.Sprintf("session failed: %v", err))
+			}
+		}(target)
+	}
+
+	allEnded := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allEnded)
+	}()
+	var handlers sync.WaitGroup
+	handlers.Add(2)
+	go func() {
+		defer handlers.Done()
+		b.handleControlSignals()
+	}()
+	go func() {
+		defer handlers.Done()
+		b.handleInput(b.readInput())
+	}()
+
+	select {
+	case <-allEnded:
+	case <-b.done:
+		wg.Wait()
+	}
+	b.stop()
+	handlers.Wait()
+	if len(started) == 0 {
+		return errors.New("no session could be started")
+	}
+	return nil
+}
+
+// runShell runs the shell session of target until it ends or the broadcast is done
+func (b *broadcast) runShell(target, ssmEndpoint string, started chan<- string) error {
+	shellSession, err := session.CreateSession(target, "", nil, ssmEndpoint)
+	if err != nil {
+		return err
+	}
+	shellSession.Supervised = true
+	shellSession.PluginOptions = ShellOptions{
+		TerminalSize: stdoutTerminalSize{},
+		Driver: func(conn io.ReadWriter) error {
+			started <- target
+			shell := b.addShell(target, conn)
+			defer b.removeShell(shell)
+
+			output := make(chan struct{})
+			go func() {
+				defer close(output)
+				buffer := make([]byte, StdinBufferLimit)
+				for {
+					n, err := conn.Read(buffer)
+					if n > 0 {
+						b.output(shell, buffer[:n])
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+			select {
+			case <-output:
+			case <-b.done:
+			}
+			return nil
+		},
+	}
+	log.Infof("Starting broadcast session %s to %s.", shellSession.SessionId, target)
+	return shellSession.Execute()
+}
+
+// addShell makes the shell of target available for input
+func (b *broadcast) addShell(target string, conn io.ReadWriter) *broadcastShell {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	shell := &broadcastShell{target: target, conn: conn}
+	b.shells[target] = shell
+	return shell
+}
+
+// removeShell displays the remaining output of the shell and stops sending input to it
+func (b *broadcast) removeShell(shell *broadcastShell) {
+	b.lock.Lock()
+	b.flushPartial(shell)
+	delete(b.shells, shell.target)
+	b.lock.Unlock()
+
+	b.notice(shell.target, "session ended")
+}
+
+// output displays output of a shell line by line, partial lines are held back for BroadcastFlushInterval
+func (b *broadcast) output(shell *broadcastShell, data []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	shell.partial = append(shell.partial, data...)
+	for {
+		i := bytes.IndexByte(shell.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.display(shell.target, shell.partial[:i])
+		shell.partial = shell.partial[i+1:]
+	}
+
+	if shell.flush != nil {
+		shell.flush.Stop()
+	}
+	if len(shell.partial) > 0 {
+		shell.flush = time.AfterFunc(BroadcastFlushInterval, func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			b.flushPartial(shell)
+		})
+	}
+}
+
+// flushPartial displays a partial line of the shell, b.lock must be held
+func (b *broadcast) flushPartial(shell *broadcastShell) {
+	if len(shell.partial) > 0 {
+		b.display(shell.target, shell.partial)
+		shell.partial = nil
+	}
+}
+
+// display writes a line of output of target in the layout of the broadcast, b.lock must be held
+func (b *broadcast) display(target string, line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	switch b.options.Layout {
+	case BroadcastPanes:
+		if b.lastLabel != target {
+			b.printf("\n──── %s ────\n", target)
+			b.lastLabel = target
+		}
+		b.printf("%s\n", line)
+	default:
+		// reset colors so that they do not carry over to the prefix of the next line
+		b.printf("[%-*s] %s\x1b[0m\n", b.width, target, line)
+	}
+}
+
+// notice displays a message of the broadcast about target
+func (b *broadcast) notice(target string, message string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.display(target, []byte("*** "+message+" ***"))
+}
+
+// readInput reads the input in the background until it ends or the broadcast is done.
+// A read pending when the broadcast is done is interrupted for files and inputs supporting read deadlines,
+// the input of other reads is dropped once they return.
+func (b *broadcast) readInput() <-chan []byte {
+	input := make(chan []byte)
+	go func() {
+		defer close(input)
+		buffer := make([]byte, StdinBufferLimit)
+		for {
+			n, err := b.options.Input.Read(buffer)
+			if n > 0 {
+				select {
+				case input <- append([]byte(nil), buffer[:n]...):
+				case <-b.done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		<-b.done
+		if deadliner, ok := b.options.Input.(interface{ SetReadDeadline(time.Time) error }); ok {
+			deadliner.SetReadDeadline(time.Now())
+		}
+	}()
+	return input
+}
+
+// handleInput sends keystrokes to the selected shells and runs the escape commands typed,
+// until the input ends or the broadcast is done
+func (b *broadcast) handleInput(input <-chan []byte) {
+	defer b.stop()
+
+	filter, _ := newEscapeFilter(DefaultEscapeChar)
+	filter.broadcastCommands = true
+	for {
+		var data []byte
+		select {
+		case <-b.done:
+			return
+		case chunk, ok := <-input:
+			if !ok {
+				return
+			}
+			data = chunk
+		}
+
+		// the command line takes the keystrokes following "~C", so the input is filtered byte by byte
+		var keystrokes []byte
+		for i := range data {
+			if b.commandLine != nil {
+				if terminated := b.editCommandLine(data[i]); terminated {
+					return
+				}
+				continue
+			}
+			output, commands := filter.filter(data[i : i+1])
+			keystrokes = append(keystrokes, output...)
+			for _, command := range commands {
+				b.send(keystrokes)
+				keystrokes = nil
+				if terminated := b.escapeCommand(command, filter); terminated {
+					return
+				}
+			}
+		}
+		b.send(keystrokes)
+	}
+}
+
+// escapeCommand runs an escape command, it returns true when the broadcast was terminated
+func (b *broadcast) escapeCommand(command byte, filter *escapeFilter) (terminated bool) {
+	switch command {
+	case escapeTerminate:
+		b.printf("\nTerminating all sessions.\n")
+		return true
+	case escapeHelp:
+		b.printf("\n%s", strings.ReplaceAll(filter.help(), "\r\n", "\n"))
+	case escapeCommandLine:
+		b.commandLine = []byte{}
+		b.printf("\n%s", broadcastPrompt)
+	}
+	return false
+}
+
+// editCommandLine adds a keystroke to the command line and runs the command on enter,
+// it returns true when the broadcast was terminated
+func (b *broadcast) editCommandLine(key byte) (terminated bool) {
+	switch {
+	case key == '\r' || key == '\n':
+		line := string(b.commandLine)
+		b.commandLine = nil
+		b.printf("\n")
+		return b.command(line)
+	case key == 0x7f || key == '\b':
+		if len(b.commandLine) > 0 {
+			b.commandLine = b.commandLine[:len(b.commandLine)-1]
+			b.echo("\b \b")
+		}
+	case key == 0x03 || key == 0x1b:
+		// Ctrl-C and escape leave the command line
+		b.commandLine = nil
+		b.printf("\n")
+	case key >= 0x20 && key < 0x7f:
+		b.commandLine = append(b.commandLine, key)
+		b.echo(string(key))
+	}
+	return false
+}
+
+// echo displays keystrokes of the command line, which the terminal does not echo in raw mode
+func (b *broadcast) echo(keystrokes string) {
+	if b.raw {
+		b.printf("%s", keystrokes)
+	}
+}
+
+// printf writes to the output, all output of the broadcast is written through it
+func (b *broadcast) printf(format string, args ...interface{}) {
+	b.outputLock.Lock()
+	defer b.outputLock.Unlock()
+	fmt.Fprintf(b.options.Output, format, args...)
+}
+
+// handleControlSignals sends control signals to the selected shells, e.g. Ctrl-C
+func (b *broadcast) handleControlSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sessionutil.ControlSignals...)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case sig := <-signals:
+			if c, ok := sessionutil.SignalsByteMap[sig]; ok {
+				b.send([]byte{c})
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// send writes input to the selected shells
+func (b *broadcast) send(input []byte) {
+	if len(input) == 0 {
+		return
+	}
+	b.lock.Lock()
+	var shells []*broadcastShell
+	for target, shell := range b.shells {
+		if b.isSelected(target) {
+			shells = append(shells, shell)
+		}
+	}
+	b.lock.Unlock()
+
+	for _, shell := range shells {
+		if _, err := shell.conn.Write(input); err != nil {
+			log.Warnf("Failed to send input to %s: %v", shell.target, err)
+		}
+	}
+}
+
+// command runs a command of the command line, it returns true when the broadcast was terminated
+func (b *broadcast) command(line string) (terminated bool) {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+	case fields[0] == "help" || fields[0] == string(escapeHelp):
+		b.printf("%s", "Commands:\n"+
+			" "+broadcastList+"               - list targets, * marks those receiving input\n"+
+			" "+broadcastSelect+" all|TARGET... - send input to all or the given targets\n"+
+			" exit               - terminate all sessions\n")
+	case fields[0] == "exit":
+		return true
+	case fields[0] == broadcastList:
+		b.list()
+	case fields[0] == broadcastSelect:
+		if err := b.selectTargets(fields[1:]); err != nil {
+			b.printf("%v\n", err)
+			return false
+		}
+		b.list()
+	default:
+		b.printf("Unknown command %q, help lists the commands.\n", line)
+	}
+	return false
+}
+
+// selectTargets selects the targets receiving input, no targets or "all" selects all of them
+func (b *broadcast) selectTargets(targets []string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(targets) == 0 || len(targets) == 1 && targets[0] == "all" {
+		b.selected = nil
+		return nil
+	}
+	selected := make(map[string]bool)
+	for _, target := range targets {
+		if !b.targets[target] {
+			return fmt.Errorf("unknown target %s", target)
+		}
+		selected[target] = true
+	}
+	b.selected = selected
+	return nil
+}
+
+// list displays the running shells and whether they receive input
+func (b *broadcast) list() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	targets := make([]string, 0, len(b.shells))
+	for target := range b.shells {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		marker := " "
+		if b.isSelected(target) {
+			marker = "*"
+		}
+		b.printf("%s %s\n", marker, target)
+	}
+}
+
+// isSelected returns true when target receives input, b.lock must be held
+func (b *broadcast) isSelected(target string) bool {
+	return b.selected == nil || b.selected[target]
+}
+
+// stop ends all shells of the broadcast and the handling of input
+func (b *broadcast) stop() {
+	b.stopOnce.Do(func() { close(b.done) })
+}
+
+// crlfWriter ends lines with a carriage return for a terminal in raw mode
+type crlfWriter struct {
+	w io.Writer
+}
+
+// Write writes p with every newline preceded by a carriage return
+func (c crlfWriter) Write(p []byte) (n int, err error) {
+	if _, err = c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBroadcast creates a broadcast to shells of targets that record their input
+func newTestBroadcast(layout BroadcastLayout, targets ...string) (*broadcast, map[string]*bytes.Buffer, *bytes.Buffer) {
+	output := &bytes.Buffer{}
+	b := &broadcast{
+		options: BroadcastOptions{Layout: layout, Output: output},
+		targets: make(map[string]bool),
+		shells:  make(map[string]*broadcastShell),
+		done:    make(chan struct{}),
+	}
+	inputs := make(map[string]*bytes.Buffer)
+	for _, target := range targets {
+		b.targets[target] = true
+		b.width = max(b.width, len(target))
+		inputs[target] = &bytes.Buffer{}
+		b.addShell(target, inputs[target])
+	}
+	return b, inputs, output
+}
+
+// typeInput runs handleInput on reads of the keyboard, it returns true when the broadcast was stopped
+func typeInput(b *broadcast, reads ...string) bool {
+	input := make(chan []byte, len(reads))
+	for _, read := range reads {
+		input <- []byte(read)
+	}
+	close(input)
+	b.handleInput(input)
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBroadcastInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		reads []string
+		// sent is the input each shell received
+		sent   map[string]string
+		output string
+	}{
+		{name: "keystrokes to all shells", reads: []string{"uptime\r"},
+			sent: map[string]string{"i-1": "uptime\r", "i-22": "uptime\r"}},
+		{name: "select a target on the command line", reads: []string{"~C", "select i-22\r", "df\r"},
+			sent:   map[string]string{"i-1": "", "i-22": "df\r"},
+			output: "\nbroadcast> \n  i-1\n* i-22\n"},
+		{name: "select all again", reads: []string{"~Cselect i-1\r~Cselect all\rw\r"},
+			sent:   map[string]string{"i-1": "w\r", "i-22": "w\r"},
+			output: "\nbroadcast> \n* i-1\n  i-22\n\nbroadcast> \n* i-1\n* i-22\n"},
+		{name: "unknown target", reads: []string{"~Cselect i-3\r"},
+			sent:   map[string]string{"i-1": "", "i-22": ""},
+			output: "\nbroadcast> \nunknown target i-3\n"},
+		{name: "command line edits", reads: []string{"~Clisx\x7ft\r"},
+			sent:   map[string]string{"i-1": "", "i-22": ""},
+			output: "\nbroadcast> \n* i-1\n* i-22\n"},
+		{name: "leave the command line", reads: []string{"~Cselect\x03ls\r"},
+			sent:   map[string]string{"i-1": "ls\r", "i-22": "ls\r"},
+			output: "\nbroadcast> \n"},
+		{name: "unknown command", reads: []string{"~Cfoo\r"},
+			sent:   map[string]string{"i-1": "", "i-22": ""},
+			output: "\nbroadcast> \nUnknown command \"foo\", help lists the commands.\n"},
+		{name: "escape sequence only after a newline", reads: []string{"echo ~C\r"},
+			sent: map[string]string{"i-1": "echo ~C\r", "i-22": "echo ~C\r"}},
+	}
+	for _, test := range tests {
+		b, inputs, output := newTestBroadcast(BroadcastInterleaved, "i-1", "i-22")
+		typeInput(b, test.reads...)
+		for target, sent := range test.sent {
+			if inputs[target].String() != sent {
+				t.Errorf("%s: %s received %q, want %q", test.name, target, inputs[target], sent)
+			}
+		}
+		if output.String() != test.output {
+			t.Errorf("%s: output %q, want %q", test.name, output, test.output)
+		}
+	}
+}
+
+func TestBroadcastTerminate(t *testing.T) {
+	for _, reads := range [][]string{{"ls\r~."}, {"~Cexit\r", "ls\r"}} {
+		b, inputs, _ := newTestBroadcast(BroadcastInterleaved, "i-1")
+		if stopped := typeInput(b, reads...); !stopped {
+			t.Errorf("input %q did not stop the broadcast", reads)
+		}
+		if sent := inputs["i-1"].String(); strings.Contains(sent, "~") || strings.Contains(sent, "exit") {
+			t.Errorf("input %q sent %q to the shell", reads, sent)
+		}
+	}
+}
+
+func TestBroadcastOutputLayouts(t *testing.T) {
+	tests := []struct {
+		layout BroadcastLayout
+		output string
+	}{
+		{layout: BroadcastInterleaved, output: "[i-1 ] one\x1b[0m\n[i-22] two\x1b[0m\n[i-1 ] three\x1b[0m\n"},
+		{layout: BroadcastPanes, output: "\n──── i-1 ────\none\n\n──── i-22 ────\ntwo\n\n──── i-1 ────\nthree\n"},
+	}
+	for _, test := range tests {
+		b, _, output := newTestBroadcast(test.layout, "i-1", "i-22")
+		b.output(b.shells["i-1"], []byte("one\r\nthr"))
+		b.output(b.shells["i-22"], []byte("two\r\n"))
+		b.output(b.shells["i-1"], []byte("ee\r\n"))
+		if output.String() != test.output {
+			t.Errorf("layout %d: output %q, want %q", test.layout, output, test.output)
+		}
+	}
+}
+
+func TestBroadcastFlushesPartialLines(t *testing.T) {
+	b, _, output := newTestBroadcast(BroadcastInterleaved, "i-1")
+	b.output(b.shells["i-1"], []byte("$ "))
+	b.outputLock.Lock()
+	if output.Len() != 0 {
+		t.Errorf("partial line displayed right away: %q", output)
+	}
+	b.outputLock.Unlock()
+	time.Sleep(BroadcastFlushInterval + 100*time.Millisecond)
+	b.outputLock.Lock()
+	defer b.outputLock.Unlock()
+	if output.String() != "[i-1] $ \x1b[0m\n" {
+		t.Errorf("output %q, want the prompt after the flush interval", output)
+	}
+}
+
+func TestCancelableReader(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	defer writer.Close()
+
+	done := make(chan struct{})
+	cancelable := newCancelableReader(reader, done)
+	writer.Write([]byte("ls"))
+	buffer := make([]byte, 16)
+	if n, err := cancelable.Read(buffer); err != nil || string(buffer[:n]) != "ls" {
+		t.Fatalf("Read() = %q, %v, want %q", buffer[:n], err, "ls")
+	}
+
+	read := make(chan error)
+	go func() {
+		_, err := cancelable.Read(buffer)
+		read <- err
+	}()
+	close(done)
+	select {
+	case err := <-read:
+		if err != io.EOF {
+			t.Errorf("pending Read() after done = %v, want EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending Read() did not return after done")
+	}
+
+	// input typed after the broadcast returned is left for the next reader
+	writer.Write([]byte("q"))
+	if n, err := reader.Read(buffer); err != nil || string(buffer[:n]) != "q" {
+		t.Errorf("next reader read %q, %v, want %q", buffer[:n], err, "q")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// broadcastInputPollInterval is how often a pending read of the input checks if the broadcast is done
+	broadcastInputPollInterval = 100 * time.Millisecond
+	// selectFdLimit is FD_SETSIZE, select cannot wait for higher descriptors
+	selectFdLimit = 1024
+)
+
+// cancelableReader reads a file only once select reports it readable, so that no read is left pending
+// after done is closed. A blocking read of a terminal cannot be interrupted otherwise.
+type cancelableReader struct {
+	fd   int
+	done <-chan struct{}
+}
+
+// newCancelableReader creates a reader of file that returns EOF once done is closed.
+// Descriptors select cannot wait for are read directly.
+func newCancelableReader(file *os.File, done <-chan struct{}) io.Reader {
+	fd := int(file.Fd())
+	if fd >= selectFdLimit {
+		return file
+	}
+	return &cancelableReader{fd: fd, done: done}
+}
+
+// Read waits until the file is readable or done is closed and reads it
+func (r *cancelableReader) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		default:
+		}
+		var readable unix.FdSet
+		readable.Set(r.fd)
+		timeout := unix.NsecToTimeval(broadcastInputPollInterval.Nanoseconds())
+		n, err := unix.Select(r.fd+1, &readable, nil, nil, &timeout)
+		if errors.Is(err, unix.EINTR) || err == nil && n == 0 {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		n, err = unix.Read(r.fd, b)
+		if errors.Is(err, unix.EINTR) || errors.Is(err, unix.EAGAIN) {
+			continue
+		} else if err != nil {
+			return 0, err
+		} else if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
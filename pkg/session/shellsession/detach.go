@@ -0,0 +1,309 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/datachannel"
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/message"
+	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/aws/session-manager-plugin/pkg/session"
+	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+)
+
+const (
+	// DetachSocketEnvVar passes the attach socket to the daemon process started by StartDetachedSession
+	DetachSocketEnvVar = "SSM_SESSION_DETACH_SOCKET"
+	// DetachSizeEnvVar passes the terminal size of the client as "WIDTHxHEIGHT" to the daemon process
+	DetachSizeEnvVar = "SSM_SESSION_DETACH_SIZE"
+
+	DefaultDetachBufferSize = 1024 * 1024
+	DetachStartTimeout      = 30 * time.Second
+
+	// detachStateSuffix is appended to the socket path for the file the daemon keeps the session state in
+	detachStateSuffix = ".session"
+)
+
+// DetachOptions run a shell session in a daemon that keeps it alive while no terminal is attached.
+type DetachOptions struct {
+	// SocketPath is the path of the attach socket, the session runs in the foreground when not set.
+	// It defaults to the value of DetachSocketEnvVar.
+	SocketPath string
+	// BufferSize is the number of bytes of output buffered while detached, DefaultDetachBufferSize when not set.
+	BufferSize int
+}
+
+// detachedSessionState is what another daemon needs to resume the session of a daemon that died.
+type detachedSessionState struct {
+	SessionId string `json:"sessionId"`
+	StreamUrl string `json:"streamUrl"`
+	TargetId  string `json:"targetId"`
+	ClientId  string `json:"clientId"`
+	Endpoint  string `json:"endpoint"`
+	Profile   string `json:"profile,omitempty"`
+	Region    string `json:"region,omitempty"`
+	// DataChannel is the state of the data channel, the session cannot be resumed without it
+	DataChannel *datachannel.ResumeState `json:"dataChannel,omitempty"`
+}
+
+// detachedStateFile keeps the state of the session of a daemon on disk while it runs
+type detachedStateFile struct {
+	lock  sync.Mutex
+	path  string
+	state detachedSessionState
+}
+
+// save writes the session state with the current state of the data channel.
+// processed is the sequence number of an output message that was processed but not acknowledged yet, -1 for none,
+// the state is saved before the acknowledgement so that a resumed session does not wait for a message it received.
+func (f *detachedStateFile) save(dataChannel datachannel.IDataChannel, processed int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	resumeState := dataChannel.GetResumeState()
+	resumeState.ExpectedSequenceNumber = max(resumeState.ExpectedSequenceNumber, processed+1)
+	if f.state.DataChannel != nil {
+		resumeState.ExpectedSequenceNumber = max(resumeState.ExpectedSequenceNumber, f.state.DataChannel.ExpectedSequenceNumber)
+	}
+	f.state.DataChannel = &resumeState
+
+	content, err := json.Marshal(f.state)
+	if err != nil {
+		return err
+	}
+	// the state is replaced at once, a daemon that dies while writing leaves the previous state
+	temporaryPath := f.path + ".tmp"
+	if err = os.WriteFile(temporaryPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, f.path)
+}
+
+// readDetachedState reads the state a daemon saved for the socket
+func readDetachedState(socketPath string) (state detachedSessionState, err error) {
+	content, err := os.ReadFile(socketPath + detachStateSuffix)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &state)
+	return
+}
+
+// initializeDaemon sets up the attach socket and the terminal size of a daemon, which has no terminal
+func (s *ShellSession) initializeDaemon() {
+	if s.shellOptions.Detach.BufferSize <= 0 {
+		s.shellOptions.Detach.BufferSize = DefaultDetachBufferSize
+	}
+	s.share = newSessionShare(ShareOptions{
+		SocketPath: s.shellOptions.Detach.SocketPath,
+		Scrollback: s.shellOptions.Detach.BufferSize,
+		// the owner of the session reattaches, the socket only lets the owner connect
+		WritableUids: []int{os.Getuid()},
+	})
+
+	if s.shellOptions.TerminalSize == nil {
+		size := FixedTerminalSize{Width: DefaultTerminalWidth, Height: DefaultTerminalHeight}
+		if value := os.Getenv(DetachSizeEnvVar); value != "" {
+			if _, err := fmt.Sscanf(value, "%dx%d", &size.Width, &size.Height); err != nil {
+				log.Warnf("Ignoring invalid terminal size %q: %v", value, err)
+				size = FixedTerminalSize{Width: DefaultTerminalWidth, Height: DefaultTerminalHeight}
+			}
+		}
+		s.shellOptions.TerminalSize = size
+	}
+
+	s.detachedState = &detachedStateFile{
+		path: s.shellOptions.Detach.SocketPath + detachStateSuffix,
+		state: detachedSessionState{
+			SessionId: s.SessionId,
+			StreamUrl: s.StreamUrl,
+			TargetId:  s.TargetId,
+			ClientId:  s.ClientId,
+			Endpoint:  s.Endpoint,
+			Profile:   sdkutil.GetProfile(),
+			Region:    sdkutil.GetSDKConfig().Region,
+		},
+	}
+}
+
+// saveDetachedState is an output handler of a daemon that saves the state before the output is acknowledged
+func (s *ShellSession) saveDetachedState(outputMessage message.ClientMessage) (isHandlerReady bool, err error) {
+	if err := s.detachedState.save(s.DataChannel, outputMessage.SequenceNumber); err != nil {
+		log.Warnf("Cannot save session state: %v", err)
+	}
+	return true, nil
+}
+
+// runDaemon keeps the session alive without a terminal until it ends, terminals attach through the socket.
+// The session state is saved whenever output was processed or input was sent, and every second
+// to drop input the agent acknowledged, so that ReattachSession can resume the session if the daemon dies.
+func (s *ShellSession) runDaemon() error {
+	ignoreHangup()
+	if err := s.detachedState.save(s.DataChannel, -1); err != nil {
+		return fmt.Errorf("cannot write session state: %v", err)
+	}
+	log.Infof("Session %s is running detached on %s.", s.SessionId, s.shellOptions.Detach.SocketPath)
+
+	for !s.DataChannel.IsSessionEnded() {
+		time.Sleep(time.Second)
+		if err := s.detachedState.save(s.DataChannel, -1); err != nil {
+			log.Warnf("Cannot save session state: %v", err)
+		}
+	}
+	os.Remove(s.detachedState.path)
+	return nil
+}
+
+// IsDetachDaemon returns true when this process is the daemon started by StartDetachedSession.
+func IsDetachDaemon() bool {
+	return os.Getenv(DetachSocketEnvVar) != ""
+}
+
+// StartDetachedSession starts the session of this process in a daemon and attaches the terminal to it.
+// The daemon runs the executable with the same arguments and DetachSocketEnvVar set, so callers start
+// the session as usual when IsDetachDaemon returns true and call StartDetachedSession otherwise:
+//
+//	if shellsession.IsDetachDaemon() {
+//		return startSession()
+//	}
+//	return shellsession.StartDetachedSession(socketPath)
+//
+// "~." or closing the terminal detaches, ReattachSession attaches again.
+func StartDetachedSession(socketPath string) error {
+	if IsDetachDaemon() {
+		return fmt.Errorf("already running as the daemon of a detached session on %s", os.Getenv(DetachSocketEnvVar))
+	}
+	if sessionutil.IsStaleUnixSocket(socketPath) {
+		os.Remove(socketPath)
+	}
+	return startDaemon(socketPath)
+}
+
+// startDaemon runs the executable with the same arguments as a daemon and attaches the terminal once it listens on socketPath
+func startDaemon(socketPath string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	daemon := exec.Command(executable, os.Args[1:]...)
+	daemon.Env = append(os.Environ(), DetachSocketEnvVar+"="+socketPath)
+	if width, height, err := GetTerminalSizeCall(int(os.Stdout.Fd())); err == nil {
+		daemon.Env = append(daemon.Env, fmt.Sprintf("%s=%dx%d", DetachSizeEnvVar, width, height))
+	}
+	daemon.SysProcAttr = daemonProcAttr()
+	if err = daemon.Start(); err != nil {
+		return fmt.Errorf("cannot start daemon: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- daemon.Wait()
+	}()
+
+	deadline := time.After(DetachStartTimeout)
+	for {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			defer conn.Close()
+			return attachTerminal(conn)
+		}
+		select {
+		case err = <-exited:
+			return fmt.Errorf("daemon exited before the session started: %v", err)
+		case <-deadline:
+			return fmt.Errorf("session did not start within %v", DetachStartTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// ReattachSession attaches the terminal to the daemon of a detached session and replays the output missed.
+//
+// When the daemon died, a new daemon resumes the session through ResumeSessionHandler with the data channel state
+// the daemon saved, the agent then sends the output again that was not acknowledged. The output buffered by the daemon
+// that died is lost. The new daemon runs the executable with the same arguments and DetachSocketEnvVar set, so callers
+// call ReattachSession there as well. Sessions with encryption cannot be resumed, they are reported so that they can
+// be terminated.
+func ReattachSession(socketPath string) error {
+	if IsDetachDaemon() {
+		return resumeDetachedSession(socketPath)
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err == nil {
+		defer conn.Close()
+		return attachTerminal(conn)
+	}
+	if !sessionutil.IsStaleUnixSocket(socketPath) {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no detached session on %s", socketPath)
+		}
+		return fmt.Errorf("cannot attach to %s: %v", socketPath, err)
+	}
+
+	// the daemon is gone, its state is kept for the daemon that resumes the session
+	os.Remove(socketPath)
+	state, err := readDetachedState(socketPath)
+	if err != nil {
+		os.Remove(socketPath + detachStateSuffix)
+		return fmt.Errorf("daemon of the detached session on %s is not running", socketPath)
+	}
+	if state.DataChannel == nil || state.DataChannel.EncryptionEnabled {
+		os.Remove(socketPath + detachStateSuffix)
+		return fmt.Errorf("daemon of session %s on %s is not running and the session cannot be resumed, "+
+			"terminate it with \"aws ssm terminate-session --session-id %s\"", state.SessionId, state.TargetId, state.SessionId)
+	}
+	if err = startDaemon(socketPath); err != nil {
+		return fmt.Errorf("cannot resume session %s: %v", state.SessionId, err)
+	}
+	return nil
+}
+
+// resumeDetachedSession runs in the daemon started by ReattachSession, it resumes the session of the daemon that died
+func resumeDetachedSession(socketPath string) error {
+	state, err := readDetachedState(socketPath)
+	if err != nil {
+		return fmt.Errorf("cannot read session state: %v", err)
+	}
+	if state.DataChannel == nil {
+		return fmt.Errorf("session %s has no data channel state to resume", state.SessionId)
+	}
+	sdkutil.SetProfile(state.Profile)
+	if state.Region != "" {
+		os.Setenv("AWS_REGION", state.Region)
+	}
+	resumedSession := &session.Session{
+		SessionId:   state.SessionId,
+		StreamUrl:   state.StreamUrl,
+		TargetId:    state.TargetId,
+		ClientId:    state.ClientId,
+		Endpoint:    state.Endpoint,
+		DataChannel: &datachannel.DataChannel{},
+		ResumeState: state.DataChannel,
+		PluginOptions: ShellOptions{
+			Detach: DetachOptions{SocketPath: socketPath},
+		},
+	}
+	if err = resumedSession.Execute(); err != nil {
+		// a session that can no longer be resumed is not tried again
+		os.Remove(socketPath + detachStateSuffix)
+	}
+	return err
+}
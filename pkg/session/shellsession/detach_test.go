@@ -0,0 +1,136 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/datachannel"
+)
+
+// resumableDataChannel is a data channel with a fixed resume state
+type resumableDataChannel struct {
+	datachannel.IDataChannel
+	state datachannel.ResumeState
+}
+
+func (r *resumableDataChannel) GetResumeState() datachannel.ResumeState {
+	return r.state
+}
+
+func TestDetachedStateFileSave(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "session")
+	stateFile := &detachedStateFile{
+		path:  socketPath + detachStateSuffix,
+		state: detachedSessionState{SessionId: "s-1", TargetId: "i-1"},
+	}
+	dataChannel := &resumableDataChannel{state: datachannel.ResumeState{
+		SessionType:              config.ShellPluginName,
+		ExpectedSequenceNumber:   3,
+		StreamDataSequenceNumber: 5,
+		UnacknowledgedMessages:   []datachannel.UnacknowledgedMessage{{SequenceNumber: 4, Content: []byte("ls")}},
+	}}
+
+	tests := []struct {
+		name      string
+		expected  int64
+		processed int64
+		want      int64
+	}{
+		{name: "state of the data channel", expected: 3, processed: -1, want: 3},
+		{name: "output processed before its acknowledgement", expected: 3, processed: 7, want: 8},
+		// the data channel increments the expected sequence number only after the output handlers ran
+		{name: "never goes back", expected: 5, processed: -1, want: 8},
+		{name: "output processed later", expected: 9, processed: -1, want: 9},
+	}
+	for _, test := range tests {
+		dataChannel.state.ExpectedSequenceNumber = test.expected
+		if err := stateFile.save(dataChannel, test.processed); err != nil {
+			t.Fatalf("%s: save() failed: %v", test.name, err)
+		}
+		state, err := readDetachedState(socketPath)
+		if err != nil {
+			t.Fatalf("%s: readDetachedState() failed: %v", test.name, err)
+		}
+		if state.DataChannel == nil || state.DataChannel.ExpectedSequenceNumber != test.want {
+			t.Errorf("%s: saved state %+v, want expected sequence number %d", test.name, state.DataChannel, test.want)
+		}
+	}
+
+	state, _ := readDetachedState(socketPath)
+	if state.SessionId != "s-1" || state.DataChannel.StreamDataSequenceNumber != 5 ||
+		len(state.DataChannel.UnacknowledgedMessages) != 1 || string(state.DataChannel.UnacknowledgedMessages[0].Content) != "ls" {
+		t.Errorf("saved state %+v, want the session and data channel state", state)
+	}
+	if _, err := os.Stat(stateFile.path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary state file left behind: %v", err)
+	}
+	if info, err := os.Stat(stateFile.path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("state file mode %v, want 0600", info.Mode().Perm())
+	}
+}
+
+// staleSocket creates a unix socket that no process listens on anymore
+func staleSocket(t *testing.T, path string) {
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+}
+
+func TestReattachSessionWithoutDaemon(t *testing.T) {
+	tests := []struct {
+		name string
+		// state is written next to a stale socket, nil for no socket at all
+		state *detachedSessionState
+		err   string
+	}{
+		{name: "no session", err: "no detached session"},
+		{name: "no state", state: &detachedSessionState{}, err: "is not running"},
+		{name: "state without data channel", state: &detachedSessionState{SessionId: "s-1", TargetId: "i-1"},
+			err: "terminate-session --session-id s-1"},
+		{name: "session with encryption", state: &detachedSessionState{SessionId: "s-1", TargetId: "i-1",
+			DataChannel: &datachannel.ResumeState{EncryptionEnabled: true}}, err: "cannot be resumed"},
+	}
+	for _, test := range tests {
+		socketPath := filepath.Join(t.TempDir(), "session")
+		if test.state != nil {
+			staleSocket(t, socketPath)
+			if test.state.SessionId != "" {
+				content, _ := json.Marshal(test.state)
+				if err := os.WriteFile(socketPath+detachStateSuffix, content, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := ReattachSession(socketPath); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: ReattachSession() = %v, want an error containing %q", test.name, err, test.err)
+		}
+		for _, path := range []string{socketPath, socketPath + detachStateSuffix} {
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("%s: %s was not removed", test.name, filepath.Base(path))
+			}
+		}
+	}
+}
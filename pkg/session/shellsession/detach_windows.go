@@ -0,0 +1,41 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build windows
+// +build windows
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+)
+
+const (
+	detachedProcess       = 0x00000008
+	createNewProcessGroup = 0x00000200
+)
+
+// daemonProcAttr starts the daemon without a console, so that it survives closing the console it was started from
+func daemonProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: detachedProcess | createNewProcessGroup}
+}
+
+// ignoreHangup keeps the daemon running when the console it was started from closes
+func ignoreHangup() {
+	signal.Ignore(append([]os.Signal{syscall.SIGHUP}, sessionutil.ControlSignals...)...)
+}
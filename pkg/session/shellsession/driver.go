@@ -0,0 +1,43 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"time"
+)
+
+// runDriver hands the shell to the driver of the shell options and terminates the session once it returns
+func (s *ShellSession) runDriver() (err error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// the session may end on the remote side while the driver waits for output
+		for !s.DataChannel.IsSessionEnded() {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		s.driverConn.Close()
+	}()
+
+	err = s.shellOptions.Driver(s.driverConn)
+	s.driverConn.Close()
+	if !s.DataChannel.IsSessionEnded() {
+		s.terminateSession()
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultEscapeChar = "~"
+	// EscapeCharNone disables escape sequences
+	EscapeCharNone = "none"
+)
+
+// escape commands, typed after the escape character at the beginning of a line
+const (
+	escapeTerminate = '.'
+	escapeHelp      = '?'
+	escapeStats     = '#'
+	// escapeShareWrite is only recognized in shared sessions
+	escapeShareWrite = 'w'
+	// escapeCommandLine is only recognized in broadcasts
+	escapeCommandLine = 'C'
+)
+
+// escapeFilter recognizes escape sequences in keyboard input, similar to OpenSSH.
+// The escape character is only recognized at the beginning of a line.
+type escapeFilter struct {
+	char         byte
+	enabled      bool
+	afterNewline bool
+	pending      bool
+	// shareCommands enables the escape commands of shared sessions
+	shareCommands bool
+	// broadcastCommands enables the escape commands of broadcasts
+	broadcastCommands bool
+}
+
+// newEscapeFilter creates a filter for the escape character of the shell options
+func newEscapeFilter(escapeChar string) (*escapeFilter, error) {
+	switch {
+	case escapeChar == "":
+		escapeChar = DefaultEscapeChar
+	case strings.EqualFold(escapeChar, EscapeCharNone):
+		return &escapeFilter{}, nil
+	case len(escapeChar) != 1:
+		return nil, fmt.Errorf("escape character must be a single ASCII character or %q, got %q", EscapeCharNone, escapeChar)
+	}
+	return &escapeFilter{char: escapeChar[0], enabled: true, afterNewline: true}, nil
+}
+
+// filter removes escape sequences from input and returns the input to send together with the escape commands typed
+func (e *escapeFilter) filter(input []byte) (output []byte, commands []byte) {
+	if !e.enabled {
+		return input, nil
+	}
+
+	output = make([]byte, 0, len(input))
+	for _, b := range input {
+		if e.pending {
+			e.pending = false
+			switch b {
+			case e.char:
+				// a doubled escape character sends the character itself, it takes precedence over the commands
+				output = append(output, b)
+				e.afterNewline = false
+				continue
+			case escapeTerminate, escapeHelp, escapeStats:
+				commands = append(commands, b)
+				e.afterNewline = b != escapeTerminate
+				continue
+			case escapeShareWrite:
+				if e.shareCommands {
+					commands = append(commands, b)
+					e.afterNewline = true
+					continue
+				}
+			case escapeCommandLine:
+				if e.broadcastCommands {
+					commands = append(commands, b)
+					e.afterNewline = true
+					continue
+				}
+			}
+			// not an escape command, send the escape character along
+			output = append(output, e.char)
+		} else if e.afterNewline && b == e.char {
+			e.pending = true
+			continue
+		}
+		output = append(output, b)
+		e.afterNewline = b == '\r' || b == '\n'
+	}
+	return output, commands
+}
+
+// help returns the help text of the escape sequences
+func (e *escapeFilter) help() string {
+	c := string(e.char)
+	if e.broadcastCommands {
+		return "Supported escape sequences:\r\n" +
+			" " + c + ".   - terminate all sessions\r\n" +
+			" " + c + "C   - open the command line to list and select targets\r\n" +
+			" " + c + "?   - this message\r\n" +
+			" " + c + c + "   - send the escape character\r\n" +
+			"(Note that escapes are only recognized immediately after newline.)\r\n"
+	}
+	help := "Supported escape sequences:\r\n" +
+		" " + c + ".   - terminate session\r\n" +
+		" " + c + "?   - this message\r\n" +
+		" " + c + "#   - show session statistics\r\n"
+	if e.shareCommands {
+		help += " " + c + "w   - grant or revoke write access of the attached viewers\r\n"
+	}
+	return help +
+		" " + c + c + "   - send the escape character\r\n" +
+		"(Note that escapes are only recognized immediately after newline.)\r\n"
+}
+
+// sessionStats counts the traffic of a shell session
+type sessionStats struct {
+	started       time.Time
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+}
+
+// handleEscapeCommands runs the escape commands typed, it returns true when the session was terminated
+func (s *ShellSession) handleEscapeCommands(commands []byte) (terminated bool) {
+	for _, command := range commands {
+		switch command {
+		case escapeTerminate:
+			fmt.Fprintf(os.Stdout, "\r\nTerminating session %s.\r\n", s.SessionId)
+			s.terminateSession()
+			return true
+		case escapeHelp:
+			fmt.Fprint(os.Stdout, "\r\n"+s.escapeFilter.help())
+		case escapeStats:
+			fmt.Fprintf(os.Stdout, "\r\nSession %s to %s\r\n SSM Agent version %s\r\n Duration %v\r\n %d bytes sent, %d bytes received\r\n",
+				s.SessionId, s.TargetId, s.DataChannel.GetAgentVersion(), time.Since(s.stats.started).Round(time.Second),
+				s.stats.bytesSent.Load(), s.stats.bytesReceived.Load())
+		case escapeShareWrite:
+			s.share.toggleWritable()
+		}
+	}
+	return false
+}
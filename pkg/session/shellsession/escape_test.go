@@ -0,0 +1,94 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"testing"
+)
+
+func TestNewEscapeFilter(t *testing.T) {
+	tests := []struct {
+		escapeChar string
+		char       byte
+		enabled    bool
+		wantErr    bool
+	}{
+		{escapeChar: "", char: '~', enabled: true},
+		{escapeChar: "^", char: '^', enabled: true},
+		{escapeChar: "none", enabled: false},
+		{escapeChar: "NONE", enabled: false},
+		{escapeChar: "~~", wantErr: true},
+	}
+	for _, test := range tests {
+		filter, err := newEscapeFilter(test.escapeChar)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("newEscapeFilter(%q) succeeded, want error", test.escapeChar)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newEscapeFilter(%q) failed: %v", test.escapeChar, err)
+		} else if filter.enabled != test.enabled || filter.enabled && filter.char != test.char {
+			t.Errorf("newEscapeFilter(%q) = %+v, want char %q enabled %v", test.escapeChar, filter, test.char, test.enabled)
+		}
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		escapeChar string
+		// inputs are filtered one after the other, as separate reads from the keyboard
+		inputs   []string
+		output   string
+		commands string
+	}{
+		{name: "plain input", inputs: []string{"ls -l\r"}, output: "ls -l\r"},
+		{name: "terminate at start", inputs: []string{"~."}, commands: "."},
+		{name: "terminate after newline", inputs: []string{"ls\r~."}, output: "ls\r", commands: "."},
+		{name: "help and stats", inputs: []string{"~?", "~#"}, commands: "?#"},
+		{name: "commands only after newline", inputs: []string{"a~."}, output: "a~."},
+		{name: "doubled escape character", inputs: []string{"~~."}, output: "~."},
+		{name: "unknown command", inputs: []string{"~x"}, output: "~x"},
+		{name: "sequence split across reads", inputs: []string{"\r~", "."}, output: "\r", commands: "."},
+		{name: "unknown command split across reads", inputs: []string{"~", "x"}, output: "~x"},
+		{name: "line feed ends a line", inputs: []string{"cat\n~?"}, output: "cat\n", commands: "?"},
+		{name: "input after help starts a line", inputs: []string{"~?~."}, commands: "?."},
+		{name: "share commands disabled", inputs: []string{"~w"}, output: "~w"},
+		{name: "other escape character", escapeChar: "^", inputs: []string{"~.\r^."}, output: "~.\r", commands: "."},
+		{name: "disabled", escapeChar: "none", inputs: []string{"~."}, output: "~."},
+		// a doubled escape character sends it even when the character is also a command
+		{name: "doubled escape character that is a command", escapeChar: ".", inputs: []string{".."}, output: "."},
+		{name: "doubled escape character that is help", escapeChar: "?", inputs: []string{"??"}, output: "?"},
+		{name: "doubled escape character that is stats", escapeChar: "#", inputs: []string{"#", "#"}, output: "#"},
+	}
+	for _, test := range tests {
+		filter, err := newEscapeFilter(test.escapeChar)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var output, commands []byte
+		for _, input := range test.inputs {
+			o, c := filter.filter([]byte(input))
+			output = append(output, o...)
+			commands = append(commands, c...)
+		}
+		if string(output) != test.output || string(commands) != test.commands {
+			t.Errorf("%s: filter(%q) = %q, commands %q, want %q, commands %q",
+				test.name, test.inputs, output, commands, test.output, test.commands)
+		}
+	}
+}
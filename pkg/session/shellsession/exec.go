@@ -0,0 +1,297 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/message"
+	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/aws/session-manager-plugin/pkg/session"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	DefaultExecConcurrency = 10
+	// ExitCodeUnknown is reported when the exit code is not known, e.g. the command did not finish
+	ExitCodeUnknown = -1
+	// execOutputPreviewLength bounds the output shown per target in the result table
+	execOutputPreviewLength = 60
+)
+
+// ExecOptions are options of ExecCommand.
+type ExecOptions struct {
+	// Concurrency is the number of targets the command runs on at the same time, DefaultExecConcurrency when not set.
+	Concurrency int
+	// DocumentName is the session document, config.NonInteractiveCommandDocumentName when not set.
+	DocumentName string
+	// SeparateOutputStream is set when the document sets separateOutputStream, the agent then sends stderr and
+	// the exit code in their own payloads. Otherwise stderr is part of stdout, and the command is run with an
+	// exit code marker that is removed from stdout.
+	SeparateOutputStream bool
+	// Timeout terminates the session of a target after this long, zero waits until the command has finished.
+	Timeout time.Duration
+	// Retries is the number of times the command is run again on targets where it failed.
+	Retries int
+}
+
+// ExecResult is the result of a command on one target.
+type ExecResult struct {
+	Target    string        `json:"target"`
+	SessionId string        `json:"sessionId,omitempty"`
+	Stdout    string        `json:"stdout"`
+	Stderr    string        `json:"stderr"`
+	ExitCode  int           `json:"exitCode"`
+	Error     string        `json:"error,omitempty"`
+	Attempts  int           `json:"attempts"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// MarshalJSON encodes the duration as a string such as "1.5s"
+func (r ExecResult) MarshalJSON() ([]byte, error) {
+	type execResult ExecResult
+	return json.Marshal(struct {
+		execResult
+		Duration string `json:"duration"`
+	}{execResult(r), r.Duration.String()})
+}
+
+// Failed returns true when the command could not be run or did not exit with zero.
+// A command without exit code has failed only if it could not be run.
+func (r ExecResult) Failed() bool {
+	return r.Error != "" || r.ExitCode != 0 && r.ExitCode != ExitCodeUnknown
+}
+
+// ExecCommand runs a non-interactive command on each target over SSM sessions and collects its output and exit code.
+// Results are in the order of the targets.
+func ExecCommand(targets []string, profile, ssmEndpoint, command string, options ExecOptions) []ExecResult {
+	sdkutil.SetProfile(profile)
+	if options.Concurrency <= 0 {
+		options.Concurrency = DefaultExecConcurrency
+	}
+	if options.DocumentName == "" {
+		options.DocumentName = config.NonInteractiveCommandDocumentName
+	}
+
+	results := make([]ExecResult, len(targets))
+	pending := make([]int, len(targets))
+	for i, target := range targets {
+		results[i] = ExecResult{Target: target}
+		pending[i] = i
+	}
+
+	for attempt := 0; attempt <= options.Retries && len(pending) > 0; attempt++ {
+		var group errgroup.Group
+		group.SetLimit(options.Concurrency)
+		for _, i := range pending {
+			i := i
+			group.Go(func() error {
+				attempts := results[i].Attempts + 1
+				results[i] = execOnTarget(results[i].Target, ssmEndpoint, command, options)
+				results[i].Attempts = attempts
+				return nil
+			})
+		}
+		group.Wait()
+
+		var failed []int
+		for _, i := range pending {
+			if results[i].Failed() {
+				failed = append(failed, i)
+			}
+		}
+		if len(failed) > 0 && attempt < options.Retries {
+			log.Infof("Command failed on %d targets, retrying.", len(failed))
+		}
+		pending = failed
+	}
+	return results
+}
+
+// FailedTargets returns the targets where the command failed, e.g. to run it there again.
+func FailedTargets(results []ExecResult) []string {
+	var targets []string
+	for _, result := range results {
+		if result.Failed() {
+			targets = append(targets, result.Target)
+		}
+	}
+	return targets
+}
+
+// execOnTarget runs the command in a session on target
+func execOnTarget(target, ssmEndpoint, command string, options ExecOptions) (result ExecResult) {
+	result = ExecResult{Target: target, ExitCode: ExitCodeUnknown}
+	started := time.Now()
+	defer func() {
+		result.Duration = time.Since(started).Round(time.Millisecond)
+	}()
+
+	var nonce string
+	if !options.SeparateOutputStream {
+		var err error
+		if nonce, err = newExitCodeNonce(); err != nil {
+			result.Error = err.Error()
+			return
+		}
+		command = exitCodeCommand(command, nonce)
+	}
+
+	execSession, err := session.CreateSession(target, options.DocumentName, map[string][]string{"command": {command}}, ssmEndpoint)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	result.SessionId = execSession.SessionId
+
+	var (
+		lock           sync.Mutex
+		stdout, stderr bytes.Buffer
+	)
+	execSession.Supervised = true
+	execSession.PluginOptions = ShellOptions{
+		OutputHandler: func(payloadType message.PayloadType, payload []byte) {
+			lock.Lock()
+			defer lock.Unlock()
+			switch payloadType {
+			case message.StdErr:
+				stderr.Write(payload)
+			case message.ExitCode:
+				if exitCode, err := strconv.Atoi(strings.TrimSpace(string(payload))); err == nil {
+					result.ExitCode = exitCode
+				} else {
+					log.Warnf("Invalid exit code %q in session %s.", payload, execSession.SessionId)
+				}
+			default:
+				stdout.Write(payload)
+			}
+		},
+	}
+
+	if options.Timeout > 0 {
+		timer := time.AfterFunc(options.Timeout, func() {
+			if execSession.DataChannel.IsSessionEnded() {
+				return
+			}
+			log.Warnf("Command on %s did not finish within %v, terminating session %s.", target, options.Timeout, execSession.SessionId)
+			lock.Lock()
+			result.Error = fmt.Sprintf("timed out after %v", options.Timeout)
+			lock.Unlock()
+			execSession.EndSession()
+		})
+		defer timer.Stop()
+	}
+
+	err = execSession.Execute()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if err != nil && result.Error == "" {
+		result.Error = err.Error()
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	if nonce != "" {
+		var exitCode int
+		if result.Stdout, exitCode = parseExitCodeMarker(result.Stdout, nonce); result.ExitCode == ExitCodeUnknown {
+			result.ExitCode = exitCode
+		}
+	}
+	return
+}
+
+// newExitCodeNonce returns a random nonce that tells the exit code marker apart from the output of the command
+func newExitCodeNonce() (string, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// exitCodeCommand makes command print its exit code after the nonce when it has finished.
+// The marker is on its own line so that it runs after a command that ends with a comment.
+func exitCodeCommand(command, nonce string) string {
+	return fmt.Sprintf("%s\necho \"%s:$?\"", command, nonce)
+}
+
+// parseExitCodeMarker removes the exit code marker from the end of stdout and returns the exit code,
+// which is ExitCodeUnknown without marker, e.g. when the session ended before the command has finished.
+func parseExitCodeMarker(stdout, nonce string) (string, int) {
+	i := strings.LastIndex(stdout, nonce+":")
+	if i < 0 {
+		return stdout, ExitCodeUnknown
+	}
+	marker := strings.TrimRight(stdout[i+len(nonce)+1:], "\r\n")
+	exitCode, err := strconv.Atoi(marker)
+	if err != nil || exitCode < 0 {
+		return stdout, ExitCodeUnknown
+	}
+	return stdout[:i], exitCode
+}
+
+// WriteExecTable writes the results as a table with the first line of output of each target
+func WriteExecTable(w io.Writer, results []ExecResult) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TARGET\tEXIT CODE\tDURATION\tATTEMPTS\tOUTPUT")
+	for _, result := range results {
+		exitCode := strconv.Itoa(result.ExitCode)
+		if result.ExitCode == ExitCodeUnknown {
+			exitCode = "-"
+		}
+		output := result.Stdout
+		if result.Error != "" {
+			output = "error: " + result.Error
+		} else if result.Failed() && result.Stderr != "" {
+			output = result.Stderr
+		}
+		fmt.Fprintf(table, "%s\t%s\t%v\t%d\t%s\n", result.Target, exitCode, result.Duration, result.Attempts, outputPreview(output))
+	}
+	return table.Flush()
+}
+
+// WriteExecJSON writes the results as a JSON array
+func WriteExecJSON(w io.Writer, results []ExecResult) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
+
+// outputPreview returns the first non-empty line of output, shortened to fit a table column
+func outputPreview(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) > execOutputPreviewLength {
+			line = line[:execOutputPreviewLength-3] + "..."
+		}
+		return line
+	}
+	return ""
+}
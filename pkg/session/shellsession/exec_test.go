@@ -0,0 +1,134 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecResultFailed(t *testing.T) {
+	tests := []struct {
+		name   string
+		result ExecResult
+		failed bool
+	}{
+		{name: "exit code zero", result: ExecResult{ExitCode: 0}, failed: false},
+		{name: "exit code one", result: ExecResult{ExitCode: 1}, failed: true},
+		{name: "no exit code", result: ExecResult{ExitCode: ExitCodeUnknown}, failed: false},
+		{name: "session error", result: ExecResult{ExitCode: ExitCodeUnknown, Error: "timed out after 1m0s"}, failed: true},
+		{name: "error despite exit code zero", result: ExecResult{ExitCode: 0, Error: "connection lost"}, failed: true},
+	}
+	for _, test := range tests {
+		if failed := test.result.Failed(); failed != test.failed {
+			t.Errorf("%s: Failed() = %v, want %v", test.name, failed, test.failed)
+		}
+	}
+}
+
+func TestFailedTargets(t *testing.T) {
+	results := []ExecResult{
+		{Target: "i-1", ExitCode: 0},
+		{Target: "i-2", ExitCode: 2},
+		{Target: "i-3", ExitCode: ExitCodeUnknown},
+		{Target: "i-4", ExitCode: ExitCodeUnknown, Error: "access denied"},
+	}
+	if targets := FailedTargets(results); !reflect.DeepEqual(targets, []string{"i-2", "i-4"}) {
+		t.Errorf("FailedTargets() = %q, want [i-2 i-4]", targets)
+	}
+}
+
+func TestOutputPreview(t *testing.T) {
+	long := strings.Repeat("x", execOutputPreviewLength+10)
+	tests := []struct {
+		output  string
+		preview string
+	}{
+		{output: "", preview: ""},
+		{output: "ok\n", preview: "ok"},
+		{output: "\n  \nfirst line\nsecond line\n", preview: "first line"},
+		{output: "  indented\r\n", preview: "indented"},
+		{output: strings.Repeat("x", execOutputPreviewLength), preview: strings.Repeat("x", execOutputPreviewLength)},
+		{output: long, preview: long[:execOutputPreviewLength-3] + "..."},
+	}
+	for _, test := range tests {
+		if preview := outputPreview(test.output); preview != test.preview {
+			t.Errorf("outputPreview(%q) = %q, want %q", test.output, preview, test.preview)
+		}
+	}
+}
+
+func TestExecResultMarshalJSON(t *testing.T) {
+	result := ExecResult{Target: "i-1", ExitCode: 0, Attempts: 1, Duration: 1500 * time.Millisecond}
+	encoded, err := result.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(encoded), `"duration":"1.5s"`) || strings.Contains(string(encoded), "sessionId") {
+		t.Errorf("MarshalJSON() = %s, want the duration as a string and no empty session id", encoded)
+	}
+}
+
+func TestParseExitCodeMarker(t *testing.T) {
+	const nonce = "0123abcd"
+	tests := []struct {
+		name     string
+		stdout   string
+		output   string
+		exitCode int
+	}{
+		{name: "marker after output", stdout: "total 0\n0123abcd:0\n", output: "total 0\n", exitCode: 0},
+		{name: "terminal line endings", stdout: "error\r\n0123abcd:127\r\n", output: "error\r\n", exitCode: 127},
+		{name: "output without newline", stdout: "no newline0123abcd:2\n", output: "no newline", exitCode: 2},
+		{name: "no output", stdout: "0123abcd:1\n", output: "", exitCode: 1},
+		{name: "command did not finish", stdout: "partial output\n", output: "partial output\n", exitCode: ExitCodeUnknown},
+		{name: "marker cut short", stdout: "partial output\n0123abcd:", output: "partial output\n0123abcd:", exitCode: ExitCodeUnknown},
+		{name: "output after the marker", stdout: "0123abcd:0\nmore\n", output: "0123abcd:0\nmore\n", exitCode: ExitCodeUnknown},
+	}
+	for _, test := range tests {
+		output, exitCode := parseExitCodeMarker(test.stdout, nonce)
+		if output != test.output || exitCode != test.exitCode {
+			t.Errorf("%s: parseExitCodeMarker() = %q, %d, want %q, %d", test.name, output, exitCode, test.output, test.exitCode)
+		}
+	}
+}
+
+func TestExitCodeCommand(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run the command")
+	}
+	const nonce = "0123abcd"
+	tests := []struct {
+		command  string
+		output   string
+		exitCode int
+	}{
+		{command: "echo hello", output: "hello\n", exitCode: 0},
+		{command: "printf hello; exit 3", output: "hello", exitCode: ExitCodeUnknown},
+		{command: "printf hello; false", output: "hello", exitCode: 1},
+		{command: "true # a comment", output: "", exitCode: 0},
+		{command: "(exit 42)", output: "", exitCode: 42},
+	}
+	for _, test := range tests {
+		stdout, _ := exec.Command(sh, "-c", exitCodeCommand(test.command, nonce)).Output()
+		if output, exitCode := parseExitCodeMarker(string(stdout), nonce); output != test.output || exitCode != test.exitCode {
+			t.Errorf("%q: output %q, exit code %d, want %q, %d", test.command, output, exitCode, test.output, test.exitCode)
+		}
+	}
+}
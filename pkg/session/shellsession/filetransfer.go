@@ -0,0 +1,443 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/sdkutil"
+	"github.com/aws/session-manager-plugin/pkg/session"
+)
+
+const (
+	DefaultTransferBlockSize = 48 * 1024
+	TransferStepTimeout      = 60 * time.Second
+	// PartialFileSuffix is appended to the destination while a transfer is in progress
+	PartialFileSuffix = ".part"
+
+	// base64LineLength keeps input lines far below the line limit of the remote terminal
+	base64LineLength = 76
+	maxShellLineSize = 1024 * 1024
+)
+
+// TransferOptions tune file transfers over shell sessions.
+type TransferOptions struct {
+	// BlockSize is the number of bytes sent and acknowledged at a time, DefaultTransferBlockSize when not set.
+	BlockSize int
+	// DisableResume starts over instead of continuing an interrupted transfer from the partial file.
+	DisableResume bool
+	// Progress is called after every block, progress is written to stderr when not set.
+	Progress func(transferred int64, total int64)
+}
+
+// remoteShell runs helper commands in the shell of a session and parses their replies.
+// Replies are lines of the form <nonce>:<key>:<value>, the nonce tells them apart from other output
+// and the commands are written so that their echo never contains a reply.
+type remoteShell struct {
+	conn  io.Writer
+	nonce string
+	lines chan string
+}
+
+// PushFile copies localPath to remotePath on target over a shell session.
+// The instance needs a POSIX shell with base64, head, tail, wc and sha256sum or shasum.
+// Data is written to remotePath with PartialFileSuffix first, an interrupted transfer continues from that file.
+func PushFile(target, profile, ssmEndpoint, localPath, remotePath string, options TransferOptions) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	options = options.withDefaults(filepath.Base(localPath))
+
+	return runTransfer(target, profile, ssmEndpoint, func(shell *remoteShell) error {
+		return shell.push(file, info.Size(), remotePath, options)
+	})
+}
+
+// PullFile copies remotePath on target to localPath over a shell session.
+// The instance needs a POSIX shell with base64, head, tail, wc and sha256sum or shasum.
+// Data is written to localPath with PartialFileSuffix first, an interrupted transfer continues from that file.
+func PullFile(target, profile, ssmEndpoint, remotePath, localPath string, options TransferOptions) error {
+	options = options.withDefaults(filepath.Base(remotePath))
+
+	return runTransfer(target, profile, ssmEndpoint, func(shell *remoteShell) error {
+		return shell.pull(remotePath, localPath, options)
+	})
+}
+
+// withDefaults fills in the default block size and progress display
+func (o TransferOptions) withDefaults(name string) TransferOptions {
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultTransferBlockSize
+	}
+	if o.Progress == nil {
+		o.Progress = func(transferred int64, total int64) {
+			percent := int64(100)
+			if total > 0 {
+				percent = transferred * 100 / total
+			}
+			fmt.Fprintf(os.Stderr, "\r%s: %d/%d bytes (%d%%)", name, transferred, total, percent)
+			if transferred == total {
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+	}
+	return o
+}
+
+// runTransfer starts a shell session on target and runs the transfer in its shell
+func runTransfer(target, profile, ssmEndpoint string, transfer func(shell *remoteShell) error) error {
+	sdkutil.SetProfile(profile)
+	shellSession, err := session.CreateSession(target, "", nil, ssmEndpoint)
+	if err != nil {
+		return err
+	}
+
+	var transferErr error
+	shellSession.Supervised = true
+	shellSession.PluginOptions = ShellOptions{
+		Driver: func(conn io.ReadWriter) error {
+			shell, err := newRemoteShell(conn)
+			if err == nil {
+				err = transfer(shell)
+			}
+			transferErr = err
+			return err
+		},
+	}
+	log.Infof("Starting file transfer in session %s.", shellSession.SessionId)
+	if err = shellSession.Execute(); transferErr != nil {
+		return transferErr
+	}
+	return err
+}
+
+// newRemoteShell prepares the shell for helper commands
+func newRemoteShell(conn io.ReadWriter) (*remoteShell, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	shell := &remoteShell{conn: conn, nonce: hex.EncodeToString(nonce), lines: make(chan string, 64)}
+
+	go func() {
+		defer close(shell.lines)
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 64*1024), maxShellLineSize)
+		for scanner.Scan() {
+			shell.lines <- strings.TrimRight(scanner.Text(), "\r")
+		}
+	}()
+
+	// turn off the terminal echo so that data is not sent back, and define the reply and checksum helpers
+	setup := fmt.Sprintf(`stty -echo 2>/dev/null; _ssmmark() { printf '%%s:%%s:%%s\n' '%s' "$1" "$2"; }; `+
+		`_ssmsum() { if command -v sha256sum >/dev/null 2>&1; then sha256sum; else shasum -a 256; fi | cut -d' ' -f1; }; `+
+		`_ssmmark READY 0`, shell.nonce)
+	if _, err := shell.query(setup, "READY"); err != nil {
+		return nil, fmt.Errorf("shell of the instance is not supported, a POSIX shell is required: %v", err)
+	}
+	return shell, nil
+}
+
+// run sends a command line to the shell, the leading space keeps it out of the shell history where ignorespace is set
+func (r *remoteShell) run(command string) error {
+	_, err := io.WriteString(r.conn, " "+command+"\n")
+	return err
+}
+
+// query runs a command and waits for its reply
+func (r *remoteShell) query(command string, key string) (string, error) {
+	if err := r.run(command); err != nil {
+		return "", err
+	}
+	return r.expect(key)
+}
+
+// expect waits for the reply with key, an ERR reply fails
+func (r *remoteShell) expect(key string) (string, error) {
+	timeout := time.After(TransferStepTimeout)
+	for {
+		select {
+		case line, ok := <-r.lines:
+			if !ok {
+				return "", errors.New("session ended")
+			}
+			replyKey, value, isReply := r.parseReply(line)
+			if !isReply {
+				log.Tracef("Ignoring shell output: %q", line)
+				continue
+			}
+			if replyKey == "ERR" {
+				return "", fmt.Errorf("remote command failed: %s", value)
+			}
+			if replyKey == key {
+				return value, nil
+			}
+		case <-timeout:
+			return "", fmt.Errorf("no %s reply within %v", key, TransferStepTimeout)
+		}
+	}
+}
+
+// parseReply returns the key and value of a reply line
+func (r *remoteShell) parseReply(line string) (key string, value string, isReply bool) {
+	i := strings.Index(line, r.nonce+":")
+	if i < 0 {
+		return "", "", false
+	}
+	key, value, _ = strings.Cut(line[i+len(r.nonce)+1:], ":")
+	return key, strings.TrimSpace(value), true
+}
+
+// expectInt waits for the reply with key and parses it as a number
+func (r *remoteShell) expectInt(key string) (int64, error) {
+	value, err := r.expect(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// push sends the content of file to remotePath
+func (r *remoteShell) push(file *os.File, size int64, remotePath string, options TransferOptions) error {
+	partPath := shellQuote(remotePath + PartialFileSuffix)
+
+	offset := int64(0)
+	if !options.DisableResume {
+		if err := r.run(fmt.Sprintf(`_ssmmark SIZE "$( (wc -c < %s) 2>/dev/null || echo 0)"`, partPath)); err != nil {
+			return err
+		}
+		partSize, err := r.expectInt("SIZE")
+		if err != nil {
+			return err
+		}
+		if partSize > 0 && partSize <= size {
+			remoteSum, err := r.query(fmt.Sprintf(`_ssmmark SUM "$(_ssmsum < %s)"`, partPath), "SUM")
+			if err != nil {
+				return err
+			}
+			if localSum, err := fileChecksum(file, partSize); err == nil && localSum == remoteSum {
+				log.Infof("Resuming transfer of %s at %d bytes.", remotePath, partSize)
+				offset = partSize
+			}
+		}
+	}
+	if offset == 0 {
+		if _, err := r.query(fmt.Sprintf(`: > %s && _ssmmark OK 0 || _ssmmark ERR "cannot write %s"`, partPath, partPath), "OK"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	options.Progress(offset, size)
+	block := make([]byte, options.BlockSize)
+	for offset < size {
+		n, err := io.ReadFull(file, block)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// wait until base64 reads, input typed earlier could be taken by the shell
+		command := fmt.Sprintf(`_ssmmark GO 0; base64 -d >> %s && _ssmmark ACK "$(wc -c < %s)" || _ssmmark ERR "write failed"`, partPath, partPath)
+		if _, err = r.query(command, "GO"); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(r.conn, encodeBase64Lines(block[:n])+"\x04"); err != nil {
+			return err
+		}
+		written, err := r.expectInt("ACK")
+		if err != nil {
+			return err
+		}
+		if written != offset+int64(n) {
+			return fmt.Errorf("remote file has %d bytes, expected %d", written, offset+int64(n))
+		}
+		offset = written
+		options.Progress(offset, size)
+	}
+	if size == 0 {
+		options.Progress(0, 0)
+	}
+
+	localSum, err := fileChecksum(file, size)
+	if err != nil {
+		return err
+	}
+	remoteSum, err := r.query(fmt.Sprintf(`_ssmmark SUM "$(_ssmsum < %s)"`, partPath), "SUM")
+	if err != nil {
+		return err
+	}
+	if remoteSum != localSum {
+		return fmt.Errorf("checksum mismatch, local %s remote %s", localSum, remoteSum)
+	}
+	_, err = r.query(fmt.Sprintf(`mv -f %s %s && _ssmmark DONE 0 || _ssmmark ERR "cannot rename %s"`, partPath, shellQuote(remotePath), partPath), "DONE")
+	return err
+}
+
+// pull receives the content of remotePath into localPath
+func (r *remoteShell) pull(remotePath string, localPath string, options TransferOptions) error {
+	quotedPath := shellQuote(remotePath)
+	if err := r.run(fmt.Sprintf(`if [ -r %s ]; then _ssmmark SIZE "$(wc -c < %s)"; else _ssmmark ERR "cannot read %s"; fi`, quotedPath, quotedPath, quotedPath)); err != nil {
+		return err
+	}
+	size, err := r.expectInt("SIZE")
+	if err != nil {
+		return err
+	}
+	remoteSum, err := r.query(fmt.Sprintf(`_ssmmark SUM "$(_ssmsum < %s)"`, quotedPath), "SUM")
+	if err != nil {
+		return err
+	}
+
+	partPath := localPath + PartialFileSuffix
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	offset := int64(0)
+	if info, err := part.Stat(); err == nil && !options.DisableResume && info.Size() > 0 && info.Size() <= size {
+		partSum, err := r.query(fmt.Sprintf(`_ssmmark SUM "$(head -c %d %s | _ssmsum)"`, info.Size(), quotedPath), "SUM")
+		if err != nil {
+			return err
+		}
+		if localSum, err := fileChecksum(part, info.Size()); err == nil && localSum == partSum {
+			log.Infof("Resuming transfer of %s at %d bytes.", remotePath, info.Size())
+			offset = info.Size()
+		}
+	}
+	if err = part.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err = part.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	options.Progress(offset, size)
+	for offset < size {
+		command := fmt.Sprintf(`_ssmmark BEGIN 0; tail -c +%d %s | head -c %d | base64; _ssmmark END 0`, offset+1, quotedPath, options.BlockSize)
+		if _, err = r.query(command, "BEGIN"); err != nil {
+			return err
+		}
+		data, err := r.readBase64Until("END")
+		if err != nil {
+			return err
+		}
+		expected := size - offset
+		if expected > int64(options.BlockSize) {
+			expected = int64(options.BlockSize)
+		}
+		if int64(len(data)) != expected {
+			return fmt.Errorf("received %d bytes at offset %d, expected %d", len(data), offset, expected)
+		}
+		if _, err = part.Write(data); err != nil {
+			return err
+		}
+		offset += int64(len(data))
+		options.Progress(offset, size)
+	}
+	if size == 0 {
+		options.Progress(0, 0)
+	}
+
+	localSum, err := fileChecksum(part, size)
+	if err != nil {
+		return err
+	}
+	if localSum != remoteSum {
+		return fmt.Errorf("checksum mismatch, local %s remote %s", localSum, remoteSum)
+	}
+	if err = part.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partPath, localPath)
+}
+
+// readBase64Until collects base64 output lines until the reply with key and decodes them
+func (r *remoteShell) readBase64Until(key string) ([]byte, error) {
+	var encoded strings.Builder
+	timeout := time.After(TransferStepTimeout)
+	for {
+		select {
+		case line, ok := <-r.lines:
+			if !ok {
+				return nil, errors.New("session ended")
+			}
+			if replyKey, value, isReply := r.parseReply(line); isReply {
+				if replyKey == "ERR" {
+					return nil, fmt.Errorf("remote command failed: %s", value)
+				}
+				if replyKey == key {
+					return base64.StdEncoding.DecodeString(encoded.String())
+				}
+				continue
+			}
+			encoded.WriteString(strings.TrimSpace(line))
+		case <-timeout:
+			return nil, fmt.Errorf("no %s reply within %v", key, TransferStepTimeout)
+		}
+	}
+}
+
+// encodeBase64Lines encodes data as base64 lines ending with a newline
+func encodeBase64Lines(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines strings.Builder
+	for len(encoded) > 0 {
+		n := base64LineLength
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		lines.WriteString(encoded[:n])
+		lines.WriteByte('\n')
+		encoded = encoded[n:]
+	}
+	return lines.String()
+}
+
+// fileChecksum returns the hex encoded SHA-256 of the first size bytes of file
+func fileChecksum(file *os.File, size int64) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// shellQuote quotes a value for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
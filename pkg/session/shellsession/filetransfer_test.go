@@ -0,0 +1,143 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoteShellParseReply(t *testing.T) {
+	shell := &remoteShell{nonce: "0123abcd"}
+	tests := []struct {
+		line    string
+		key     string
+		value   string
+		isReply bool
+	}{
+		{line: "0123abcd:SIZE:1024", key: "SIZE", value: "1024", isReply: true},
+		{line: "0123abcd:SUM:ab:cd", key: "SUM", value: "ab:cd", isReply: true},
+		{line: "0123abcd:READY:0 ", key: "READY", value: "0", isReply: true},
+		// a prompt written before the reply on the same line
+		{line: "$ 0123abcd:ERR:no such file", key: "ERR", value: "no such file", isReply: true},
+		{line: "0123abcd:DONE", key: "DONE", value: "", isReply: true},
+		{line: "total 0", isReply: false},
+		// the echo of a helper command contains the nonce but not followed by a colon
+		{line: "_ssmmark '0123abcd' SIZE", isReply: false},
+		{line: "ffffffff:SIZE:1", isReply: false},
+	}
+	for _, test := range tests {
+		key, value, isReply := shell.parseReply(test.line)
+		if key != test.key || value != test.value || isReply != test.isReply {
+			t.Errorf("parseReply(%q) = %q, %q, %v, want %q, %q, %v",
+				test.line, key, value, isReply, test.key, test.value, test.isReply)
+		}
+	}
+}
+
+func TestRemoteShellExpect(t *testing.T) {
+	shell := &remoteShell{nonce: "n0", lines: make(chan string, 8)}
+	for _, line := range []string{"motd", "n0:READY:0", "n0:SIZE:42"} {
+		shell.lines <- line
+	}
+	if size, err := shell.expectInt("SIZE"); err != nil || size != 42 {
+		t.Errorf("expectInt(SIZE) = %d, %v, want 42", size, err)
+	}
+
+	shell.lines <- "n0:ERR:permission denied"
+	if _, err := shell.expect("SIZE"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expect() of an ERR reply = %v, want the remote error", err)
+	}
+
+	close(shell.lines)
+	if _, err := shell.expect("SIZE"); err == nil {
+		t.Error("expect() succeeded after the session ended")
+	}
+}
+
+func TestRemoteShellReadBase64Until(t *testing.T) {
+	data := bytes.Repeat([]byte("file content\n"), 20)
+	shell := &remoteShell{nonce: "n0", lines: make(chan string, 64)}
+	for _, line := range strings.Split(encodeBase64Lines(data), "\n") {
+		if line != "" {
+			shell.lines <- line + "\r"
+		}
+	}
+	shell.lines <- "n0:EOF:0"
+	if decoded, err := shell.readBase64Until("EOF"); err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("readBase64Until() = %q, %v, want the encoded data", decoded, err)
+	}
+}
+
+func TestEncodeBase64Lines(t *testing.T) {
+	for _, size := range []int{0, 1, 57, 58, 1000} {
+		data := bytes.Repeat([]byte{0xff, 0x00, 'a'}, size)[:size]
+		encoded := encodeBase64Lines(data)
+		if size == 0 && encoded != "" {
+			t.Errorf("encodeBase64Lines() of no data = %q, want nothing", encoded)
+		}
+		if size > 0 && !strings.HasSuffix(encoded, "\n") {
+			t.Errorf("encodeBase64Lines() of %d bytes does not end with a newline", size)
+		}
+		lines := strings.Split(strings.TrimSuffix(encoded, "\n"), "\n")
+		for _, line := range lines {
+			if len(line) > base64LineLength {
+				t.Errorf("encodeBase64Lines() of %d bytes has a line of %d characters", size, len(line))
+			}
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, "")); err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("encodeBase64Lines() of %d bytes does not decode to the data: %v", size, err)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		value  string
+		quoted string
+	}{
+		{value: "", quoted: "''"},
+		{value: "/tmp/file", quoted: "'/tmp/file'"},
+		{value: "my file; rm -rf /", quoted: "'my file; rm -rf /'"},
+		{value: "$HOME/`id`", quoted: "'$HOME/`id`'"},
+		{value: "it's", quoted: `'it'\''s'`},
+	}
+	for _, test := range tests {
+		if quoted := shellQuote(test.value); quoted != test.quoted {
+			t.Errorf("shellQuote(%q) = %s, want %s", test.value, quoted, test.quoted)
+		}
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, []byte("abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	// sha256 of "abc", only the first bytes of a partial file are compared
+	const abc = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if sum, err := fileChecksum(file, 3); err != nil || sum != abc {
+		t.Errorf("fileChecksum() = %s, %v, want %s", sum, err, abc)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/aws/session-manager-plugin/pkg/message"
+)
+
+const (
+	// maxPredictions bounds the unconfirmed keystrokes displayed, so that predictions stay on the current line
+	maxPredictions = 32
+	// promptTailLimit is the length of the last output line kept to recognize password prompts
+	promptTailLimit = 128
+
+	underlineOn  = "\x1b[4m"
+	underlineOff = "\x1b[24m"
+	clearLineEnd = "\x1b[K"
+)
+
+var (
+	// alternate screen switches of full-screen applications such as vim, less and top
+	alternateScreenOn  = [][]byte{[]byte("\x1b[?1049h"), []byte("\x1b[?1047h"), []byte("\x1b[?47h")}
+	alternateScreenOff = [][]byte{[]byte("\x1b[?1049l"), []byte("\x1b[?1047l"), []byte("\x1b[?47l")}
+
+	passwordPromptPattern = regexp.MustCompile(`(?i)\b(password|passphrase|passcode|pin)\b[^:\n]*:\s*$`)
+)
+
+// predictiveEcho displays keystrokes before the remote shell echoes them, similar to mosh.
+// Predictions are underlined until the echo confirms them. A mismatching echo erases the predictions
+// and suspends predicting until the next line. Nothing is predicted in full-screen applications or at password prompts.
+type predictiveEcho struct {
+	lock       sync.Mutex
+	display    func(payload []byte)
+	pending    []byte
+	fullScreen bool
+	// suspended stops predicting until the next line, waitForEcho until the output caught up with the input
+	suspended   bool
+	waitForEcho bool
+	promptTail  []byte
+}
+
+// newPredictiveEcho creates a predictor writing through display
+func newPredictiveEcho(display func(payload []byte)) *predictiveEcho {
+	return &predictiveEcho{display: display}
+}
+
+// typed records input sent to the remote shell and displays the keystrokes that can be predicted
+func (p *predictiveEcho) typed(input []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var predicted []byte
+	for _, b := range input {
+		switch {
+		case b == '\r' || b == '\n':
+			// a new line ends a password prompt or a mismatch, the keystrokes predicted so far are still displayed.
+			// Where the next line starts is only known from the echo.
+			p.suspended = false
+			p.promptTail = nil
+			p.waitForEcho = true
+			continue
+		case b < 0x20 || b > 0x7e:
+			// control keys and escape sequences move the cursor in ways that cannot be predicted
+			p.waitForEcho = true
+			continue
+		case p.fullScreen || p.suspended || p.waitForEcho || len(p.pending) >= maxPredictions:
+			continue
+		}
+		p.pending = append(p.pending, b)
+		predicted = append(predicted, b)
+	}
+	if len(predicted) > 0 {
+		p.display([]byte(underlineOn + string(predicted) + underlineOff))
+	}
+}
+
+// output displays output of the remote shell and reconciles the echoed keystrokes with the predictions
+func (p *predictiveEcho) output(payload []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	shown := len(p.pending)
+	p.trackScreen(payload)
+	if shown == 0 {
+		p.waitForEcho = false
+		p.display(payload)
+		return
+	}
+
+	// erase the predictions, the echo replaces them with the confirmed characters
+	erase := []byte(fmt.Sprintf("\x1b[%dD%s", shown, clearLineEnd))
+	confirmed := 0
+	for confirmed < len(p.pending) && confirmed < len(payload) && payload[confirmed] == p.pending[confirmed] {
+		confirmed++
+	}
+	if confirmed < len(p.pending) && confirmed < len(payload) {
+		// the echo differs from the prediction, e.g. the shell does not echo or completed a word
+		p.pending = nil
+		p.suspended = true
+	} else {
+		p.pending = p.pending[confirmed:]
+	}
+
+	p.display(append(erase, payload...))
+	if len(p.pending) > 0 && !p.fullScreen {
+		p.display([]byte(underlineOn + string(p.pending) + underlineOff))
+	} else {
+		p.pending = nil
+	}
+}
+
+// trackScreen recognizes full-screen applications and password prompts in the output
+func (p *predictiveEcho) trackScreen(payload []byte) {
+	for _, sequence := range alternateScreenOn {
+		if bytes.Contains(payload, sequence) {
+			p.fullScreen = true
+		}
+	}
+	for _, sequence := range alternateScreenOff {
+		if bytes.Contains(payload, sequence) {
+			p.fullScreen = false
+		}
+	}
+
+	if i := bytes.LastIndexAny(payload, "\r\n"); i >= 0 {
+		p.promptTail = append([]byte(nil), payload[i+1:]...)
+	} else {
+		p.promptTail = append(p.promptTail, payload...)
+	}
+	if len(p.promptTail) > promptTailLimit {
+		p.promptTail = p.promptTail[len(p.promptTail)-promptTailLimit:]
+	}
+	if passwordPromptPattern.Match(p.promptTail) {
+		p.suspended = true
+		p.pending = nil
+	}
+}
+
+// displayOutput writes output of the remote shell through the predictor when predictive echo is enabled
+func (s *ShellSession) displayOutput(outputMessage message.ClientMessage) {
+	if s.predictor == nil {
+		s.DisplayMode.DisplayMessage(outputMessage)
+		return
+	}
+	s.predictor.output(outputMessage.Payload)
+}
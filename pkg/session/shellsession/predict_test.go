@@ -0,0 +1,108 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// predicted is how a prediction of the keystrokes is displayed
+func predicted(keystrokes string) string {
+	return underlineOn + keystrokes + underlineOff
+}
+
+// erased is how n displayed predictions are removed before the echo is written
+func erased(n int) string {
+	return fmt.Sprintf("\x1b[%dD%s", n, clearLineEnd)
+}
+
+func TestPredictiveEcho(t *testing.T) {
+	tests := []struct {
+		name string
+		// events are keyboard input sent to the shell, prefixed with "<", and shell output, prefixed with ">"
+		events   []string
+		displays []string
+	}{
+		{
+			name:     "echo confirms the prediction",
+			events:   []string{">$ ", "<ls", ">ls"},
+			displays: []string{"$ ", predicted("ls"), erased(2) + "ls"},
+		},
+		{
+			name:     "command and newline in one read",
+			events:   []string{">$ ", "<ls\r", ">ls\r\nfile\r\n$ "},
+			displays: []string{"$ ", predicted("ls"), erased(2) + "ls\r\nfile\r\n$ "},
+		},
+		{
+			name:     "input after a newline waits for the echo",
+			events:   []string{">$ ", "<ls\rpwd", ">ls\r\n$ ", "<x", ">pwdx"},
+			displays: []string{"$ ", predicted("ls"), erased(2) + "ls\r\n$ ", "pwdx"},
+		},
+		{
+			name:     "partial echo keeps the rest predicted",
+			events:   []string{"<abc", ">a"},
+			displays: []string{predicted("abc"), erased(3) + "a", predicted("bc")},
+		},
+		{
+			name:     "mismatch suspends predictions until the next line",
+			events:   []string{"<ab", ">xy", "<c", ">c", "<\r", ">\r\n$ ", "<d"},
+			displays: []string{predicted("ab"), erased(2) + "xy", "c", "\r\n$ ", predicted("d")},
+		},
+		{
+			name:     "password prompt",
+			events:   []string{">[sudo] password for user: ", "<secret\r", ">\r\n$ ", "<ls"},
+			displays: []string{"[sudo] password for user: ", "\r\n$ ", predicted("ls")},
+		},
+		{
+			name:     "password prompt hides predictions shown before it",
+			events:   []string{"<ab", ">Passphrase for key: "},
+			displays: []string{predicted("ab"), erased(2) + "Passphrase for key: "},
+		},
+		{
+			name:     "full-screen application",
+			events:   []string{">\x1b[?1049h", "<jj", ">x", ">\x1b[?1049l$ ", "<q", ">q"},
+			displays: []string{"\x1b[?1049h", "x", "\x1b[?1049l$ ", predicted("q"), erased(1) + "q"},
+		},
+		{
+			name:     "control keys wait for the echo",
+			events:   []string{"<\t", "<a", ">file", "<b"},
+			displays: []string{"file", predicted("b")},
+		},
+		{
+			name:     "predictions are bounded",
+			events:   []string{"<" + strings.Repeat("a", maxPredictions+5)},
+			displays: []string{predicted(strings.Repeat("a", maxPredictions))},
+		},
+	}
+	for _, test := range tests {
+		var displays []string
+		predictor := newPredictiveEcho(func(payload []byte) {
+			displays = append(displays, string(payload))
+		})
+		for _, event := range test.events {
+			if strings.HasPrefix(event, "<") {
+				predictor.typed([]byte(event[1:]))
+			} else {
+				predictor.output([]byte(event[1:]))
+			}
+		}
+		if !reflect.DeepEqual(displays, test.displays) {
+			t.Errorf("%s: displayed %q, want %q", test.name, displays, test.displays)
+		}
+	}
+}
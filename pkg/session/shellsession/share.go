@@ -0,0 +1,349 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/message"
+	"github.com/aws/session-manager-plugin/pkg/session/sessionutil"
+	"golang.org/x/term"
+)
+
+const (
+	DefaultShareScrollback = 64 * 1024
+	// DefaultShareSocketMode only lets the owner of the session attach, other users need a wider mode
+	DefaultShareSocketMode = 0600
+	// shareViewerQueueSize bounds the output queued for a viewer, slower viewers are detached
+	shareViewerQueueSize = 256
+)
+
+// ShareOptions expose a shell session on a local unix socket for other local users to watch.
+type ShareOptions struct {
+	// SocketPath is the path of the attach socket, sharing is disabled when not set.
+	SocketPath string
+	// SocketMode is the file mode of the socket, DefaultShareSocketMode when not set.
+	SocketMode os.FileMode
+	// Scrollback is the number of bytes of output replayed to a viewer that attaches, DefaultShareScrollback when not set.
+	Scrollback int
+	// WritableUids grants write access from the start to viewers running as one of these users.
+	// Other viewers attach read-only, "~w" grants write access to the viewers attached at that time.
+	WritableUids []int
+}
+
+// sessionShare sends the output of a shell session to the viewers attached to its socket.
+// Input of a viewer is only forwarded to the shell while that viewer has write access.
+type sessionShare struct {
+	options    ShareOptions
+	listener   net.Listener
+	lock       sync.Mutex
+	scrollback []byte
+	viewers    map[*shareViewer]bool
+	nextId     int
+	closed     bool
+}
+
+// shareViewer is a connection attached to a shared session
+type shareViewer struct {
+	id   int
+	conn net.Conn
+	// uid is the user of the viewer process, -1 when it cannot be determined
+	uid      int
+	writable bool
+	output   chan []byte
+}
+
+// newSessionShare creates a share recording the scrollback, viewers can attach once it is listening
+func newSessionShare(options ShareOptions) *sessionShare {
+	if options.SocketMode == 0 {
+		options.SocketMode = DefaultShareSocketMode
+	}
+	if options.Scrollback <= 0 {
+		options.Scrollback = DefaultShareScrollback
+	}
+	return &sessionShare{options: options, viewers: make(map[*shareViewer]bool)}
+}
+
+// listen opens the attach socket and accepts viewers, input of viewers with write access is passed to sendInput
+func (p *sessionShare) listen(banner string, sendInput func(input []byte)) (err error) {
+	if sessionutil.IsStaleUnixSocket(p.options.SocketPath) {
+		log.Infof("Removing stale attach socket %s.", p.options.SocketPath)
+		os.Remove(p.options.SocketPath)
+	}
+	// only the owner can connect until the mode is set
+	if p.listener, err = sessionutil.ListenUnixSocket(p.options.SocketPath); err != nil {
+		return fmt.Errorf("cannot open attach socket: %v", err)
+	}
+	if err = os.Chmod(p.options.SocketPath, p.options.SocketMode); err != nil {
+		p.listener.Close()
+		return fmt.Errorf("cannot set mode of attach socket: %v", err)
+	}
+	log.Infof("Sharing session on %s.", p.options.SocketPath)
+
+	go func() {
+		for {
+			conn, err := p.listener.Accept()
+			if err != nil {
+				log.Debugf("Stopped accepting viewers: %v", err)
+				return
+			}
+			p.attach(conn, banner, sendInput)
+		}
+	}()
+	return nil
+}
+
+// attach replays the scrollback to a new viewer and starts forwarding output to it
+func (p *sessionShare) attach(conn net.Conn, banner string, sendInput func(input []byte)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		conn.Close()
+		return
+	}
+	p.nextId++
+	viewer := &shareViewer{id: p.nextId, conn: conn, uid: -1, output: make(chan []byte, shareViewerQueueSize)}
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		if uid, err := sessionutil.GetUnixPeerUid(unixConn); err == nil {
+			viewer.uid = uid
+		} else {
+			log.Warnf("Unable to determine the user of viewer %d: %v", viewer.id, err)
+		}
+	}
+	viewer.writable = viewer.uid >= 0 && slices.Contains(p.options.WritableUids, viewer.uid)
+	p.viewers[viewer] = true
+	viewer.output <- []byte(fmt.Sprintf("%s (%s)\r\n", banner, viewer.access()))
+	viewer.output <- append([]byte(nil), p.scrollback...)
+	p.notify(fmt.Sprintf("Viewer %d (%s) attached %s, %d attached.", viewer.id, viewer.user(), viewer.access(), len(p.viewers)))
+
+	go func() {
+		for payload := range viewer.output {
+			if _, err := conn.Write(payload); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}()
+	go func() {
+		buffer := make([]byte, StdinBufferLimit)
+		for {
+			n, err := conn.Read(buffer)
+			if n > 0 && p.isWritable(viewer) {
+				sendInput(append([]byte(nil), buffer[:n]...))
+			}
+			if err != nil {
+				break
+			}
+		}
+		p.detach(viewer)
+	}()
+}
+
+// detach removes a viewer
+func (p *sessionShare) detach(viewer *shareViewer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.viewers[viewer] {
+		delete(p.viewers, viewer)
+		close(viewer.output)
+		p.notify(fmt.Sprintf("Viewer %d detached, %d attached.", viewer.id, len(p.viewers)))
+	}
+}
+
+// output records output of the shell in the scrollback and sends it to the viewers
+func (p *sessionShare) output(payload []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.scrollback = append(p.scrollback, payload...)
+	if over := len(p.scrollback) - p.options.Scrollback; over > 0 {
+		p.scrollback = append(p.scrollback[:0], p.scrollback[over:]...)
+	}
+	for viewer := range p.viewers {
+		select {
+		case viewer.output <- append([]byte(nil), payload...):
+		default:
+			log.Warnf("Detaching viewer %d of shared session as it does not keep up with the output.", viewer.id)
+			delete(p.viewers, viewer)
+			close(viewer.output)
+		}
+	}
+}
+
+// isWritable returns true while the viewer has write access
+func (p *sessionShare) isWritable(viewer *shareViewer) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return viewer.writable
+}
+
+// toggleWritable grants write access to the viewers attached now when one of them is read-only, otherwise it revokes
+// write access of all viewers. Viewers attaching later are read-only.
+func (p *sessionShare) toggleWritable() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.viewers) == 0 {
+		p.notify("No viewers attached.")
+		return
+	}
+	grant := false
+	for viewer := range p.viewers {
+		grant = grant || !viewer.writable
+	}
+	var changed []*shareViewer
+	for viewer := range p.viewers {
+		if viewer.writable != grant {
+			viewer.writable = grant
+			changed = append(changed, viewer)
+		}
+	}
+	slices.SortFunc(changed, func(a, b *shareViewer) int { return a.id - b.id })
+	var names []string
+	for _, viewer := range changed {
+		names = append(names, fmt.Sprintf("%d (%s)", viewer.id, viewer.user()))
+	}
+	if grant {
+		p.notify("Write access granted to viewer " + strings.Join(names, ", ") + ".")
+	} else {
+		p.notify("Write access revoked from viewer " + strings.Join(names, ", ") + ".")
+	}
+}
+
+// access describes the access of the viewer, p.lock must be held
+func (v *shareViewer) access() string {
+	if v.writable {
+		return "writable"
+	}
+	return "read-only"
+}
+
+// user describes the user of the viewer process
+func (v *shareViewer) user() string {
+	if v.uid < 0 {
+		return "uid unknown"
+	}
+	return fmt.Sprintf("uid %d", v.uid)
+}
+
+// notify shows a message about the share to the owner and the viewers, p.lock must be held
+func (p *sessionShare) notify(notice string) {
+	line := []byte("\r\n[" + notice + "]\r\n")
+	os.Stdout.Write(line)
+	for viewer := range p.viewers {
+		select {
+		case viewer.output <- line:
+		default:
+		}
+	}
+}
+
+// close stops accepting viewers, detaches all viewers and removes the socket
+func (p *sessionShare) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.listener != nil {
+		p.listener.Close()
+		os.Remove(p.options.SocketPath)
+	}
+	for viewer := range p.viewers {
+		delete(p.viewers, viewer)
+		close(viewer.output)
+	}
+}
+
+// sendSharedInput sends input of a viewer with write access to the shell
+func (s *ShellSession) sendSharedInput(input []byte) {
+	if err := s.DataChannel.SendInputDataMessage(message.Output, input); err != nil {
+		log.Errorf("Failed to send input of viewer: %v", err)
+		return
+	}
+	s.stats.bytesSent.Add(int64(len(input)))
+	s.recordInput(input)
+	if s.detachedState != nil {
+		if err := s.detachedState.save(s.DataChannel, -1); err != nil {
+			log.Warnf("Cannot save session state: %v", err)
+		}
+	}
+}
+
+// AttachSharedSession attaches the terminal to a session shared on socketPath and shows its output.
+// Keyboard input is sent to the session once its owner granted write access, "~." detaches.
+func AttachSharedSession(socketPath string) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return attachTerminal(conn)
+}
+
+// attachTerminal sends keyboard input to conn and displays its output until either side closes, "~." detaches
+func attachTerminal(conn net.Conn) (err error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(os.Stdin.Fd()), state)
+	}
+
+	filter, _ := newEscapeFilter(DefaultEscapeChar)
+	go func() {
+		buffer := make([]byte, StdinBufferLimit)
+		for {
+			n, err := os.Stdin.Read(buffer)
+			input, commands := filter.filter(buffer[:n])
+			for _, command := range commands {
+				switch command {
+				case escapeTerminate:
+					fmt.Fprint(os.Stdout, "\r\nDetached.\r\n")
+					conn.Close()
+					return
+				case escapeHelp:
+					fmt.Fprint(os.Stdout, "\r\nSupported escape sequences:\r\n "+DefaultEscapeChar+".   - detach\r\n")
+				}
+			}
+			if len(input) > 0 {
+				if _, err := conn.Write(input); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	if _, err = io.Copy(os.Stdout, conn); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
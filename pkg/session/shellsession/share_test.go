@@ -0,0 +1,229 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionShareScrollbackLimit(t *testing.T) {
+	const output = "0123456789"
+	tests := []struct {
+		limit int
+		// chunk is the size of the output messages output is split into
+		chunk int
+		kept  string
+	}{
+		{limit: 20, chunk: 3, kept: "0123456789"},
+		{limit: 10, chunk: 10, kept: "0123456789"},
+		{limit: 4, chunk: 3, kept: "6789"},
+		{limit: 4, chunk: 1, kept: "6789"},
+		{limit: 3, chunk: 10, kept: "789"},
+	}
+	for _, test := range tests {
+		share := newSessionShare(ShareOptions{Scrollback: test.limit})
+		for i := 0; i < len(output); i += test.chunk {
+			share.output([]byte(output[i:min(i+test.chunk, len(output))]))
+		}
+		if kept := string(share.scrollback); kept != test.kept {
+			t.Errorf("scrollback of %d bytes written in chunks of %d = %q, want %q", test.limit, test.chunk, kept, test.kept)
+		}
+	}
+
+	share := newSessionShare(ShareOptions{})
+	share.output([]byte(strings.Repeat("a", DefaultShareScrollback)))
+	share.output([]byte("b"))
+	if len(share.scrollback) != DefaultShareScrollback || share.scrollback[len(share.scrollback)-1] != 'b' {
+		t.Errorf("scrollback of %d bytes, want the last %d bytes of output", len(share.scrollback), DefaultShareScrollback)
+	}
+}
+
+func TestSessionShareReplaysScrollback(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "share.sock")
+	share := newSessionShare(ShareOptions{SocketPath: socketPath, Scrollback: 8})
+	if err := share.listen("shared", func([]byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	defer share.close()
+	share.output([]byte("$ make\r\n"))
+	share.output([]byte("ok\r\n$ "))
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	if banner, err := reader.ReadString('\n'); err != nil || banner != "shared (read-only)\r\n" {
+		t.Fatalf("banner %q, %v", banner, err)
+	}
+	// a viewer sees the last 8 bytes of output first, then the attach notice and live output
+	replayed := make([]byte, 8)
+	if _, err := io.ReadFull(reader, replayed); err != nil || string(replayed) != "\r\nok\r\n$ " {
+		t.Errorf("viewer received scrollback %q, %v, want %q", replayed, err, "\r\nok\r\n$ ")
+	}
+	reader.ReadString('\n')
+	if notice, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(notice, "[Viewer 1 (uid ") {
+		t.Errorf("viewer received notice %q, %v, want its attach notice", notice, err)
+	}
+	share.output([]byte("ls"))
+	live := make([]byte, 2)
+	if _, err := io.ReadFull(reader, live); err != nil || string(live) != "ls" {
+		t.Errorf("viewer received %q, %v, want live output %q", live, err, "ls")
+	}
+}
+
+func TestSessionShareOutputIsCopied(t *testing.T) {
+	share := newSessionShare(ShareOptions{Scrollback: 10})
+	payload := []byte("abc")
+	share.output(payload)
+	copy(payload, "xyz")
+	if kept := string(share.scrollback); kept != "abc" {
+		t.Errorf("scrollback %q changed with the payload, want %q", kept, "abc")
+	}
+}
+
+func TestEscapeFilterShareCommands(t *testing.T) {
+	tests := []struct {
+		name       string
+		escapeChar string
+		input      string
+		output     string
+		commands   string
+	}{
+		{name: "toggle write access", input: "~w", commands: "w"},
+		{name: "toggle after newline", input: "ls\r~w", output: "ls\r", commands: "w"},
+		{name: "doubled escape character", input: "~~w", output: "~w"},
+		// with "w" as escape character, "ww" sends "w" instead of toggling write access
+		{name: "escape character w", escapeChar: "w", input: "ww", output: "w"},
+		{name: "escape character w terminates", escapeChar: "w", input: "w.", commands: "."},
+	}
+	for _, test := range tests {
+		filter, err := newEscapeFilter(test.escapeChar)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		filter.shareCommands = true
+		output, commands := filter.filter([]byte(test.input))
+		if string(output) != test.output || string(commands) != test.commands {
+			t.Errorf("%s: filter(%q) = %q, commands %q, want %q, commands %q",
+				test.name, test.input, output, commands, test.output, test.commands)
+		}
+	}
+}
+
+// attachViewer connects a viewer to the share and returns the access shown in its banner
+func attachViewer(t *testing.T, socketPath string) (net.Conn, string) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(banner), "shared ("), ")")
+}
+
+// expectInput waits for input forwarded to the shell, an empty want checks that nothing is forwarded
+func expectInput(t *testing.T, input <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-input:
+		if got != want {
+			t.Errorf("forwarded input %q, want %q", got, want)
+		}
+	case <-time.After(100 * time.Millisecond):
+		if want != "" {
+			t.Errorf("input %q was not forwarded", want)
+		}
+	}
+}
+
+func TestSessionShareWriteAccessPerViewer(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "share.sock")
+	share := newSessionShare(ShareOptions{SocketPath: socketPath})
+	input := make(chan string, 8)
+	if err := share.listen("shared", func(data []byte) { input <- string(data) }); err != nil {
+		t.Fatal(err)
+	}
+	defer share.close()
+
+	first, access := attachViewer(t, socketPath)
+	if access != "read-only" {
+		t.Errorf("first viewer attached %s, want read-only", access)
+	}
+	first.Write([]byte("a"))
+	expectInput(t, input, "")
+
+	// the grant applies to the viewers attached at that time only
+	share.toggleWritable()
+	second, access := attachViewer(t, socketPath)
+	if access != "read-only" {
+		t.Errorf("viewer attached after the grant %s, want read-only", access)
+	}
+	first.Write([]byte("b"))
+	expectInput(t, input, "b")
+	second.Write([]byte("c"))
+	expectInput(t, input, "")
+
+	// with a read-only viewer attached, "~w" grants write access to it as well
+	share.toggleWritable()
+	second.Write([]byte("d"))
+	expectInput(t, input, "d")
+
+	share.toggleWritable()
+	first.Write([]byte("e"))
+	second.Write([]byte("f"))
+	expectInput(t, input, "")
+}
+
+func TestSessionShareWritableUids(t *testing.T) {
+	if os.Getuid() < 0 {
+		t.Skip("users are not identified by uid on this platform")
+	}
+	socketPath := filepath.Join(t.TempDir(), "share.sock")
+	share := newSessionShare(ShareOptions{SocketPath: socketPath, WritableUids: []int{os.Getuid()}})
+	input := make(chan string, 8)
+	if err := share.listen("shared", func(data []byte) { input <- string(data) }); err != nil {
+		t.Fatal(err)
+	}
+	defer share.close()
+
+	viewer, access := attachViewer(t, socketPath)
+	if access != "writable" {
+		t.Errorf("viewer of a granted user attached %s, want writable", access)
+	}
+	viewer.Write([]byte("a"))
+	expectInput(t, input, "a")
+
+	share.lock.Lock()
+	for v := range share.viewers {
+		if v.uid != os.Getuid() {
+			t.Errorf("viewer uid %d, want %d", v.uid, os.Getuid())
+		}
+	}
+	share.lock.Unlock()
+}
@@ -16,6 +16,8 @@ package shellsession
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"time"
@@ -29,8 +31,19 @@ import (
 )
 
 const (
-	ResizeSleepInterval = time.Millisecond * 500
-	StdinBufferLimit    = 1024
+	ResizeSleepInterval    = time.Millisecond * 500
+	ResizeDebounceInterval = time.Millisecond * 100
+	StdinBufferLimit       = 1024
+
+	// TerminateSessionTimeout bounds the wait for the remote end when the session is terminated by the client
+	TerminateSessionTimeout = 2 * time.Second
+
+	// EndOfTransmission ends the input of the remote shell like Ctrl-D at the beginning of a line
+	EndOfTransmission = 0x04
+
+	// DefaultTerminalWidth and DefaultTerminalHeight are used when the terminal size cannot be determined
+	DefaultTerminalWidth  = 300
+	DefaultTerminalHeight = 100
 )
 
 type ShellSession struct {
@@ -39,6 +52,86 @@ type ShellSession struct {
 	// SizeData is used to store size data at session level to compare with new size.
 	SizeData          message.SizeData
 	originalTermState *term.State
+	shellOptions      ShellOptions
+	escapeFilter      *escapeFilter
+	stats             *sessionStats
+	// pipedInput is set when stdin is not a terminal, e.g. for scripted sessions
+	pipedInput bool
+	predictor  *predictiveEcho
+	driverConn *sessionutil.DataChannelConn
+	transcript *transcript
+	share      *sessionShare
+	// daemon is set when the session runs detached from any terminal, refer to DetachOptions
+	daemon bool
+	// detachedState is saved by a daemon for ReattachSession to resume the session
+	detachedState *detachedStateFile
+	// transcriptErr fails the session when the transcript file cannot be written
+	transcriptErr error
+}
+
+// ShellOptions are client side options of a shell session, passed in through session.Session.PluginOptions.
+type ShellOptions struct {
+	// TerminalSize provides the size of the terminal, the terminal on stdout when not set.
+	TerminalSize TerminalSizeProvider
+	// EscapeChar is the escape character recognized at the beginning of a line, DefaultEscapeChar when not set.
+	// EscapeCharNone disables escape sequences.
+	EscapeChar string
+	// PredictiveEcho displays keystrokes underlined before the remote shell echoes them, for high-latency connections.
+	PredictiveEcho bool
+	// Driver runs the session programmatically instead of the keyboard, e.g. for file transfers.
+	// It writes input to and reads output from the shell, the session is terminated once it returns.
+	Driver func(shell io.ReadWriter) error
+	// OutputHandler receives the output instead of the terminal, together with its payload type,
+	// message.Output, message.StdErr or message.ExitCode, e.g. for non-interactive commands.
+	// No input is sent unless a Driver is set, which then receives no output.
+	OutputHandler func(payloadType message.PayloadType, payload []byte)
+	// TranscriptFile appends a plain-text transcript of the shell output to the file, for audit trails.
+	// Escape sequences are stripped and lines are prefixed with RFC3339 timestamps.
+	TranscriptFile string
+	// Detach runs the session in a daemon that terminals attach to, refer to StartDetachedSession.
+	Detach DetachOptions
+	// Share exposes the session on a local unix socket for other local users to watch, refer to AttachSharedSession.
+	Share ShareOptions
+	// TranscriptInput also records the commands typed, input at password prompts is left out.
+	TranscriptInput bool
+}
+
+// TerminalSizeProvider reports the size of the terminal a shell session is displayed in.
+type TerminalSizeProvider interface {
+	// Size returns the current width and height in characters.
+	Size() (width int, height int, err error)
+	// Changes returns a channel that receives a value whenever the size may have changed until done is closed,
+	// or nil if the size never changes.
+	Changes(done <-chan struct{}) <-chan struct{}
+}
+
+// FixedTerminalSize is a TerminalSizeProvider with a constant size, e.g. for non-TTY or embedded use.
+type FixedTerminalSize struct {
+	Width  int
+	Height int
+}
+
+// Size returns the fixed size
+func (f FixedTerminalSize) Size() (width int, height int, err error) {
+	return f.Width, f.Height, nil
+}
+
+// Changes returns nil as the size never changes
+func (f FixedTerminalSize) Changes(done <-chan struct{}) <-chan struct{} {
+	return nil
+}
+
+// stdoutTerminalSize reports the size of the terminal on stdout
+type stdoutTerminalSize struct{}
+
+// Size returns the size of the terminal on stdout
+func (stdoutTerminalSize) Size() (width int, height int, err error) {
+	return GetTerminalSizeCall(int(os.Stdout.Fd()))
+}
+
+// Changes notifies terminal size changes, refer to terminalSizeChanges of the platform
+func (stdoutTerminalSize) Changes(done <-chan struct{}) <-chan struct{} {
+	return terminalSizeChanges(done)
 }
 
 var GetTerminalSizeCall = func(fd int) (width int, height int, err error) {
@@ -56,7 +149,50 @@ func (ShellSession) Name() string {
 
 func (s *ShellSession) Initialize(sessionVar *session.Session) {
 	s.Session = *sessionVar
+	s.shellOptions = getShellOptions(s.PluginOptions)
+	if s.shellOptions.Detach.SocketPath == "" {
+		s.shellOptions.Detach.SocketPath = os.Getenv(DetachSocketEnvVar)
+	}
+	if s.shellOptions.Detach.SocketPath != "" && s.shellOptions.Driver == nil {
+		s.daemon = true
+		s.initializeDaemon()
+	}
+	if s.shellOptions.Driver != nil {
+		s.driverConn = sessionutil.NewDataChannelConn(s.DataChannel, s.SessionId, s.TargetId)
+		if s.shellOptions.TerminalSize == nil {
+			s.shellOptions.TerminalSize = FixedTerminalSize{Width: DefaultTerminalWidth, Height: DefaultTerminalHeight}
+		}
+	} else if s.shellOptions.TerminalSize == nil {
+		s.shellOptions.TerminalSize = stdoutTerminalSize{}
+	}
+	s.stats = &sessionStats{started: time.Now()}
+	if s.shellOptions.TranscriptFile != "" {
+		if s.transcript, s.transcriptErr = newTranscript(s.shellOptions.TranscriptFile, s.shellOptions.TranscriptInput); s.transcriptErr == nil {
+			s.transcript.header("Session %s started, target %s, agent version %s",
+				s.SessionId, s.TargetId, s.DataChannel.GetAgentVersion())
+		}
+	}
+	if s.driverConn != nil || s.shellOptions.OutputHandler != nil || s.daemon {
+		s.shellOptions.EscapeChar = EscapeCharNone
+		s.shellOptions.PredictiveEcho = false
+	} else if s.pipedInput = !term.IsTerminal(int(os.Stdin.Fd())); s.pipedInput {
+		// escape sequences and predictions are only meant for interactive use
+		s.shellOptions.EscapeChar = EscapeCharNone
+		s.shellOptions.PredictiveEcho = false
+	}
+	// ProcessStreamMessagePayload is registered on a copy of the session, so the predictor is decided here
+	if s.shellOptions.PredictiveEcho {
+		s.predictor = newPredictiveEcho(func(payload []byte) {
+			s.DisplayMode.DisplayMessage(message.ClientMessage{Payload: payload})
+		})
+	}
+	if s.shellOptions.Share.SocketPath != "" && !s.daemon {
+		s.share = newSessionShare(s.shellOptions.Share)
+	}
 	s.DataChannel.RegisterOutputStreamHandler(s.ProcessStreamMessagePayload, true)
+	if s.daemon {
+		s.DataChannel.RegisterOutputStreamHandler(s.saveDetachedState, true)
+	}
 	s.DataChannel.GetWsChannel().SetOnMessage(
 		func(input []byte) {
 			s.DataChannel.OutputMessageHandler(s.Stop, s.SessionId, input)
@@ -65,13 +201,44 @@ func (s *ShellSession) Initialize(sessionVar *session.Session) {
 
 // StartSession takes input and write it to data channel
 func (s *ShellSession) SetSessionHandlers() (err error) {
+	if s.transcriptErr != nil {
+		return s.transcriptErr
+	}
+	if s.share != nil {
+		banner := fmt.Sprintf("Attached to session %s on %s", s.SessionId, s.TargetId)
+		if err = s.share.listen(banner, s.sendSharedInput); err != nil {
+			return
+		}
+	}
+	if s.escapeFilter, err = newEscapeFilter(s.shellOptions.EscapeChar); err != nil {
+		return
+	}
+	s.escapeFilter.shareCommands = s.share != nil
 
-	// handle re-size
-	s.handleTerminalResize()
+	// send the initial size before any input and handle re-size
+	stopResize := s.handleTerminalResize()
+	defer stopResize()
+
+	if s.driverConn != nil {
+		return s.runDriver()
+	}
+	if s.daemon {
+		return s.runDaemon()
+	}
+	if s.shellOptions.OutputHandler != nil {
+		for !s.DataChannel.IsSessionEnded() {
+			time.Sleep(time.Second)
+		}
+		return nil
+	}
 
 	// handle control signals
 	s.handleControlSignals()
 
+	if s.pipedInput {
+		return s.handlePipedInput()
+	}
+
 	//handles keyboard input
 	err = s.handleKeyboardInput()
 
@@ -94,46 +261,224 @@ func (s *ShellSession) handleControlSignals() {
 	}()
 }
 
-// handleTerminalResize checks size of terminal every 500ms and sends size data.
-func (s *ShellSession) handleTerminalResize() {
-	var (
-		width         int
-		height        int
-		inputSizeData []byte
-		err           error
-	)
+// handleTerminalResize sends the initial terminal size, then sends the size again whenever it changed.
+// Changes are debounced so that a window being dragged results in a single update.
+// The returned function stops watching for changes once the session has ended.
+func (s *ShellSession) handleTerminalResize() (stop func()) {
+	s.sendTerminalSize(true)
+
+	done := make(chan struct{})
+	stop = func() { close(done) }
+	changes := s.shellOptions.TerminalSize.Changes(done)
+	if changes == nil {
+		return
+	}
 	go func() {
+		var debounce <-chan time.Time
 		for {
-			// If running from IDE GetTerminalSizeCall will not work. Supply a fixed width and height value.
-			if width, height, err = GetTerminalSizeCall(int(os.Stdout.Fd())); err != nil {
-				width = 300
-				height = 100
-				log.Errorf("Could not get size of the terminal: %s, using width %d height %d", err, width, height)
+			select {
+			case <-done:
+				return
+			case <-changes:
+				debounce = time.After(ResizeDebounceInterval)
+			case <-debounce:
+				debounce = nil
+				if s.DataChannel.IsSessionEnded() {
+					return
+				}
+				s.sendTerminalSize(false)
 			}
+		}
+	}()
+	return
+}
 
-			if s.SizeData.Rows != uint32(height) || s.SizeData.Cols != uint32(width) {
-				sizeData := message.SizeData{
-					Cols: uint32(width),
-					Rows: uint32(height),
-				}
-				s.SizeData = sizeData
+// sendTerminalSize sends the terminal size to the agent if it differs from the last size sent.
+// When the size cannot be determined the initial size falls back to the default size and later sizes are left unchanged.
+func (s *ShellSession) sendTerminalSize(initial bool) {
+	width, height, err := s.shellOptions.TerminalSize.Size()
+	if err != nil {
+		if !initial {
+			log.Debugf("Could not get size of the terminal: %s", err)
+			return
+		}
+		// If running from IDE the terminal size is not available. Supply a fixed width and height value.
+		width, height = DefaultTerminalWidth, DefaultTerminalHeight
+		log.Warnf("Could not get size of the terminal: %s, using width %d height %d", err, width, height)
+	}
 
-				if inputSizeData, err = json.Marshal(sizeData); err != nil {
-					log.Errorf("Cannot marshall size data: %v", err)
-				}
-				log.Debugf("Sending input size data: %s", inputSizeData)
-				if err = s.DataChannel.SendInputDataMessage(message.Size, inputSizeData); err != nil {
-					log.Errorf("Failed to Send size data: %v", err)
+	if s.SizeData.Rows == uint32(height) && s.SizeData.Cols == uint32(width) {
+		return
+	}
+	sizeData := message.SizeData{
+		Cols: uint32(width),
+		Rows: uint32(height),
+	}
+	s.SizeData = sizeData
+
+	inputSizeData, err := json.Marshal(sizeData)
+	if err != nil {
+		log.Errorf("Cannot marshall size data: %v", err)
+		return
+	}
+	log.Debugf("Sending input size data: %s", inputSizeData)
+	if err = s.DataChannel.SendInputDataMessage(message.Size, inputSizeData); err != nil {
+		log.Errorf("Failed to Send size data: %v", err)
+	}
+}
+
+// handlePipedInput forwards stdin that is not a terminal until EOF, then ends the input of the remote shell
+// and waits until the session is closed, which happens after the remaining output was received.
+func (s *ShellSession) handlePipedInput() (err error) {
+	log.Debugf("Stdin is not a terminal, forwarding input until EOF.")
+
+	type stdinRead struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan stdinRead)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			stdinBytes := make([]byte, StdinBufferLimit)
+			n, err := os.Stdin.Read(stdinBytes)
+			select {
+			case ch <- stdinRead{stdinBytes[:n], err}:
+			case <-done:
+				// the session ended before EOF, the read data is not sent anymore
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	lastByte := byte('\n')
+	for inputOpen := true; inputOpen; {
+		select {
+		case <-time.After(time.Second):
+			if s.DataChannel.IsSessionEnded() {
+				return nil
+			}
+		case read := <-ch:
+			if len(read.data) > 0 {
+				if err = s.DataChannel.SendInputDataMessage(message.Output, read.data); err != nil {
+					return
 				}
+				s.stats.bytesSent.Add(int64(len(read.data)))
+				s.recordInput(read.data)
+				lastByte = read.data[len(read.data)-1]
 			}
-			// repeating this loop for every 500ms
-			time.Sleep(ResizeSleepInterval)
+			if read.err == io.EOF {
+				inputOpen = false
+			} else if read.err != nil {
+				return read.err
+			}
+		}
+	}
+
+	eof := []byte{EndOfTransmission}
+	if lastByte != '\n' && lastByte != '\r' {
+		eof = []byte{'\n', EndOfTransmission}
+	}
+	log.Debugf("End of input, waiting for session %s to close.", s.SessionId)
+	if err = s.DataChannel.SendInputDataMessage(message.Output, eof); err != nil {
+		return
+	}
+	for !s.DataChannel.IsSessionEnded() {
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+// sendKeyboardInput sends input typed by the user after handling escape sequences.
+// It returns true when the session was terminated by an escape sequence.
+func (s *ShellSession) sendKeyboardInput(input []byte) (terminated bool, err error) {
+	input, commands := s.escapeFilter.filter(input)
+	if len(input) > 0 {
+		// the prediction is registered first, the echo may arrive before SendInputDataMessage returns
+		if s.predictor != nil {
+			s.predictor.typed(input)
+		}
+		if err = s.DataChannel.SendInputDataMessage(message.Output, input); err != nil {
+			return false, err
 		}
+		s.stats.bytesSent.Add(int64(len(input)))
+		s.recordInput(input)
+	}
+	return s.handleEscapeCommands(commands), nil
+}
+
+// terminateSession ends the session without waiting for the remote shell.
+// The network may be down, so the session is only terminated remotely on a best effort basis.
+func (s *ShellSession) terminateSession() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.EndSession()
 	}()
+	select {
+	case <-done:
+	case <-time.After(TerminateSessionTimeout):
+		log.Debugf("Session %s was not terminated within %v.", s.SessionId, TerminateSessionTimeout)
+	}
+	s.Stop()
+}
+
+// recordInput adds input sent to the shell to the transcript, if any
+func (s *ShellSession) recordInput(input []byte) {
+	if s.transcript != nil {
+		s.transcript.typed(input)
+	}
+}
+
+// closeTranscript writes the end of the session to the transcript, if any
+func (s *ShellSession) closeTranscript() {
+	if s.transcript != nil {
+		s.transcript.close(fmt.Sprintf("Session %s ended, duration %v, %d bytes sent, %d bytes received",
+			s.SessionId, time.Since(s.stats.started).Round(time.Second), s.stats.bytesSent.Load(), s.stats.bytesReceived.Load()))
+	}
+}
+
+// closeShare detaches the viewers of a shared session, if any
+func (s *ShellSession) closeShare() {
+	if s.share != nil {
+		s.share.close()
+	}
+}
+
+// getShellOptions returns the shell options set on the session, if any.
+func getShellOptions(pluginOptions interface{}) ShellOptions {
+	switch shellOptions := pluginOptions.(type) {
+	case ShellOptions:
+		return shellOptions
+	case *ShellOptions:
+		if shellOptions != nil {
+			return *shellOptions
+		}
+	}
+	return ShellOptions{}
 }
 
 // ProcessStreamMessagePayload prints payload received on datachannel to console
 func (s ShellSession) ProcessStreamMessagePayload(outputMessage message.ClientMessage) (isHandlerReady bool, err error) {
-	s.DisplayMode.DisplayMessage(outputMessage)
+	s.stats.bytesReceived.Add(int64(len(outputMessage.Payload)))
+	if s.transcript != nil {
+		s.transcript.output(outputMessage.Payload)
+	}
+	if s.share != nil {
+		s.share.output(outputMessage.Payload)
+	}
+	if s.shellOptions.OutputHandler != nil {
+		s.shellOptions.OutputHandler(message.PayloadType(outputMessage.PayloadType), outputMessage.Payload)
+		return true, nil
+	}
+	if s.driverConn != nil {
+		s.driverConn.Push(outputMessage.Payload)
+		return true, nil
+	}
+	s.displayOutput(outputMessage)
 	return true, nil
 }
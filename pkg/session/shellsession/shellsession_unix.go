@@ -20,16 +20,43 @@ package shellsession
 import (
 	"bufio"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/aws/session-manager-plugin/pkg/log"
-	"github.com/aws/session-manager-plugin/pkg/message"
 	"golang.org/x/term"
 )
 
 // stop restores the terminal settings and exits
 func (s *ShellSession) Stop() {
-	term.Restore(int(os.Stdin.Fd()), s.originalTermState)
+	s.closeTranscript()
+	s.closeShare()
+	if s.originalTermState != nil {
+		term.Restore(int(os.Stdin.Fd()), s.originalTermState)
+	}
+}
+
+// terminalSizeChanges notifies terminal size changes on SIGWINCH until done is closed
+func terminalSizeChanges(done <-chan struct{}) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
 }
 
 // handleKeyboardInput handles input entered by customer on terminal
@@ -61,7 +88,8 @@ func (s *ShellSession) handleKeyboardInput() (err error) {
 				return
 			}
 		case stdinBytes := <-ch:
-			if err = s.Session.DataChannel.SendInputDataMessage(message.Output, stdinBytes[:stdinBytesLen]); err != nil {
+			var terminated bool
+			if terminated, err = s.sendKeyboardInput(stdinBytes[:stdinBytesLen]); err != nil || terminated {
 				return
 			}
 		}
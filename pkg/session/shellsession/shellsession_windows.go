@@ -21,7 +21,6 @@ import (
 	"time"
 
 	"github.com/aws/session-manager-plugin/pkg/log"
-	"github.com/aws/session-manager-plugin/pkg/message"
 	"github.com/eiannone/keyboard"
 )
 
@@ -54,7 +53,32 @@ var specialKeysInputMap = map[keyboard.Key][]byte{
 
 // stop restores the terminal settings and exits
 func (s *ShellSession) Stop() {
-	keyboard.Close()
+	s.closeTranscript()
+	s.closeShare()
+	if !s.pipedInput {
+		keyboard.Close()
+	}
+}
+
+// terminalSizeChanges polls the terminal size until done is closed as windows has no resize signal
+func terminalSizeChanges(done <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(ResizeSleepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
 }
 
 // handleKeyboardInput handles input entered by customer on terminal
@@ -93,18 +117,24 @@ func (s *ShellSession) handleKeyboardInput() (err error) {
 			}
 		case charStr := <-charCH:
 			charBytes := []byte(string(charStr))
-			if err = s.Session.DataChannel.SendInputDataMessage(message.Output, charBytes); err != nil {
+			var terminated bool
+			if terminated, err = s.sendKeyboardInput(charBytes); err != nil {
 				log.Errorf("Failed to send UTF8 char: %v", err)
 				return
+			} else if terminated {
+				return
 			}
 		case keyStr := <-keyCH:
 			keyBytes := []byte(string(keyStr))
 			if byteValue, ok := specialKeysInputMap[key]; ok {
 				keyBytes = byteValue
 			}
-			if err = s.Session.DataChannel.SendInputDataMessage(message.Output, keyBytes); err != nil {
+			var terminated bool
+			if terminated, err = s.sendKeyboardInput(keyBytes); err != nil {
 				log.Errorf("Failed to send UTF8 char: %v", err)
 				return
+			} else if terminated {
+				return
 			}
 		}
 	}
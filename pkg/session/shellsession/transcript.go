@@ -0,0 +1,194 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/pkg/log"
+)
+
+// ansi escape sequence states of the transcript
+const (
+	ansiText = iota
+	ansiEscape
+	ansiCSI
+	ansiString
+	ansiStringEscape
+)
+
+// transcript writes a plain-text transcript of a shell session for human review.
+// Escape sequences are stripped and each line is prefixed with the RFC3339 time it started.
+type transcript struct {
+	lock         sync.Mutex
+	file         *os.File
+	writer       *bufio.Writer
+	includeInput bool
+
+	line      []byte
+	lineStart time.Time
+	ansiState int
+	input     []byte
+}
+
+// newTranscript creates the transcript file, appending to an existing file
+func newTranscript(path string, includeInput bool) (*transcript, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open transcript file: %v", err)
+	}
+	return &transcript{file: file, writer: bufio.NewWriter(file), includeInput: includeInput}, nil
+}
+
+// header writes a line marking the start or end of the session
+func (t *transcript) header(format string, args ...interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.file == nil {
+		return
+	}
+	t.flushLine()
+	fmt.Fprintf(t.writer, "%s === %s ===\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+	t.writer.Flush()
+}
+
+// output records output of the remote shell
+func (t *transcript) output(payload []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.file == nil {
+		return
+	}
+	for _, b := range payload {
+		switch t.ansiState {
+		case ansiEscape:
+			switch b {
+			case '[':
+				t.ansiState = ansiCSI
+			case ']', 'P', '_', '^', 'X':
+				// OSC, DCS and other strings end with BEL or ST
+				t.ansiState = ansiString
+			default:
+				if b < 0x20 || b > 0x2f {
+					// intermediate bytes continue the sequence, anything else ends it
+					t.ansiState = ansiText
+				}
+			}
+		case ansiCSI:
+			if b >= 0x40 && b <= 0x7e {
+				t.ansiState = ansiText
+			}
+		case ansiString:
+			if b == 0x07 {
+				t.ansiState = ansiText
+			} else if b == 0x1b {
+				t.ansiState = ansiStringEscape
+			}
+		case ansiStringEscape:
+			if b == '\\' {
+				t.ansiState = ansiText
+			} else {
+				t.ansiState = ansiString
+			}
+		default:
+			t.text(b)
+		}
+	}
+	t.writer.Flush()
+}
+
+// text adds a character of output that is not part of an escape sequence to the current line
+func (t *transcript) text(b byte) {
+	switch {
+	case b == 0x1b:
+		t.ansiState = ansiEscape
+	case b == '\n':
+		t.flushLine()
+	case b == '\b':
+		if len(t.line) > 0 {
+			t.line = t.line[:len(t.line)-1]
+		}
+	case b == '\t' || b >= 0x20 && b != 0x7f:
+		if t.line == nil {
+			t.lineStart = time.Now()
+		}
+		t.line = append(t.line, b)
+	}
+}
+
+// flushLine writes the current output line
+func (t *transcript) flushLine() {
+	if t.line == nil {
+		return
+	}
+	fmt.Fprintf(t.writer, "%s %s\n", t.lineStart.Format(time.RFC3339), t.line)
+	t.line = nil
+}
+
+// typed records input typed by the user when enabled, one line per command.
+// Input typed at a password prompt is left out.
+func (t *transcript) typed(input []byte) {
+	if !t.includeInput {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.file == nil {
+		return
+	}
+	for _, b := range input {
+		switch {
+		case b == '\r' || b == '\n':
+			command := string(t.input)
+			if passwordPromptPattern.Match(t.line) {
+				command = "(hidden)"
+			}
+			fmt.Fprintf(t.writer, "%s > %s\n", time.Now().Format(time.RFC3339), command)
+			t.input = nil
+		case b == 0x7f || b == '\b':
+			if len(t.input) > 0 {
+				t.input = t.input[:len(t.input)-1]
+			}
+		case b == 0x03 || b == 0x15:
+			// Ctrl-C and Ctrl-U discard the line
+			t.input = nil
+		case b >= 0x20:
+			t.input = append(t.input, b)
+		}
+	}
+	t.writer.Flush()
+}
+
+// close writes the end header and closes the file, later calls do nothing
+func (t *transcript) close(footer string) {
+	t.header("%s", footer)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file == nil {
+		return
+	}
+	if err := t.file.Close(); err != nil {
+		log.Warnf("Failed to close transcript file: %v", err)
+	}
+	t.file = nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package shellsession starts shell session.
+package shellsession
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordOutput writes payloads to a new transcript and returns its lines without the end header
+func recordOutput(t *testing.T, payloads ...string) []string {
+	path := filepath.Join(t.TempDir(), "transcript.log")
+	transcript, err := newTranscript(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range payloads {
+		transcript.output([]byte(payload))
+	}
+	transcript.close("end")
+	lines := readTranscript(t, path)
+	if last := lines[len(lines)-1]; last != "=== end ===" {
+		t.Fatalf("transcript ends with %q, want the end header", last)
+	}
+	return lines[:len(lines)-1]
+}
+
+func TestTranscriptStripsEscapeSequences(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		text   string
+	}{
+		{name: "SGR colors", output: "\x1b[1;31merror\x1b[0m: failed\r\n", text: "error: failed"},
+		{name: "cursor movement and erase", output: "\x1b[2J\x1b[H\x1b[?25lready\r\n", text: "ready"},
+		{name: "window title ended by BEL", output: "\x1b]0;user@host: ~\x07$ ls\r\n", text: "$ ls"},
+		{name: "window title ended by ST", output: "\x1b]2;title\x1b\\$ pwd\r\n", text: "$ pwd"},
+		{name: "ESC inside a string does not end it", output: "\x1b]0;a\x1bb\x07c\r\n", text: "c"},
+		{name: "charset selection with intermediate byte", output: "\x1b(Bplain\r\n", text: "plain"},
+		{name: "keypad modes", output: "\x1b=\x1b>keypad\r\n", text: "keypad"},
+		{name: "device control string", output: "\x1bPq#0;2;0;0;0\x1b\\sixel\r\n", text: "sixel"},
+		{name: "backspace erases", output: "lss\b \b\r\n", text: "ls"},
+		{name: "other control characters dropped, tab kept", output: "a\x07b\tc\x7f\r\n", text: "ab\tc"},
+	}
+	for _, test := range tests {
+		if lines := recordOutput(t, test.output); !reflect.DeepEqual(lines, []string{test.text}) {
+			t.Errorf("%s: transcript %q, want %q", test.name, lines, test.text)
+		}
+	}
+}
+
+func TestTranscriptEscapeSequenceSplitAcrossOutputs(t *testing.T) {
+	// the remote shell may split an escape sequence between output messages, here at every byte
+	var payloads []string
+	for _, b := range []byte("\x1b[38;5;196mred\x1b[0m \x1b]0;title\x1b\\text\r\n") {
+		payloads = append(payloads, string(b))
+	}
+	if lines := recordOutput(t, payloads...); !reflect.DeepEqual(lines, []string{"red text"}) {
+		t.Errorf("transcript %q, want %q", lines, "red text")
+	}
+}
+
+func TestTranscriptLines(t *testing.T) {
+	lines := recordOutput(t, "one\r\n\r\n", "\x1b[0m\r\ntwo\r", "\nthr", "ee\r\n$ ")
+	// lines without text are left out, the prompt is written when the transcript is closed
+	if want := []string{"one", "two", "three", "$ "}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("transcript %q, want %q", lines, want)
+	}
+}
+
+func TestTranscriptAppendsAndCloses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.log")
+	for _, session := range []string{"s-1", "s-2"} {
+		transcript, err := newTranscript(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transcript.header("session %s", session)
+		transcript.output([]byte("hello\r\n"))
+		transcript.close("end of " + session)
+		// recording after close is ignored
+		transcript.output([]byte("late\r\n"))
+		transcript.close("closed twice")
+	}
+	want := []string{"=== session s-1 ===", "hello", "=== end of s-1 ===", "=== session s-2 ===", "hello", "=== end of s-2 ==="}
+	if lines := readTranscript(t, path); !reflect.DeepEqual(lines, want) {
+		t.Errorf("transcript %q, want %q", lines, want)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("transcript file mode %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+}
+
+func TestTranscriptTyped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.log")
+	transcript, err := newTranscript(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript.output([]byte("$ "))
+	transcript.typed([]byte("lss\x7f -l\r"))
+	transcript.output([]byte("ls -l\r\ntotal 0\r\n$ "))
+	transcript.typed([]byte("typo\x15sudo id\r"))
+	transcript.output([]byte("sudo id\r\n[sudo] password for user: "))
+	transcript.typed([]byte("secret\r"))
+	transcript.typed([]byte("sleep 9\x03"))
+	transcript.close("end")
+
+	want := []string{
+		"> ls -l",
+		"$ ls -l",
+		"total 0",
+		"> sudo id",
+		"$ sudo id",
+		"> (hidden)",
+		"[sudo] password for user: ",
+		"=== end ===",
+	}
+	if lines := readTranscript(t, path); !reflect.DeepEqual(lines, want) {
+		t.Errorf("transcript %q, want %q", lines, want)
+	}
+}
+
+// readTranscript returns the lines of a transcript without their timestamps
+func readTranscript(t *testing.T, path string) []string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		timestamp, text, _ := strings.Cut(line, " ")
+		if _, err := time.Parse(time.RFC3339, timestamp); err != nil {
+			t.Fatalf("line %q does not start with a timestamp: %v", line, err)
+		}
+		lines = append(lines, text)
+	}
+	return lines
+}
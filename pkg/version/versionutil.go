@@ -0,0 +1,82 @@
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package version contains CLI version constant and utilities.
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/session-manager-plugin/pkg/config"
+	"github.com/aws/session-manager-plugin/pkg/log"
+)
+
+// DoesAgentSupportTCPMultiplexing returns true if the agent version supports multiplexed port forwarding.
+// Agents without handshake report no version, an agent version that cannot be parsed is treated as a current agent.
+func DoesAgentSupportTCPMultiplexing(agentVersion string) bool {
+	return isAgentVersionGreaterThan(agentVersion, config.TCPMultiplexingSupportedAfterThisAgentVersion)
+}
+
+// DoesAgentSupportDisableSmuxKeepAlive returns true if the agent keeps multiplexed sessions open without smux keepalives.
+func DoesAgentSupportDisableSmuxKeepAlive(agentVersion string) bool {
+	return isAgentVersionGreaterThan(agentVersion, config.TCPMultiplexingWithSmuxKeepAliveDisabledAfterThisAgentVersion)
+}
+
+// isAgentVersionGreaterThan returns true if agentVersion is greater than baseVersion
+func isAgentVersionGreaterThan(agentVersion string, baseVersion string) bool {
+	if agentVersion == "" {
+		return false
+	}
+	result, err := CompareVersions(agentVersion, baseVersion)
+	if err != nil {
+		log.Warnf("Unable to compare agent version %q with %q: %v", agentVersion, baseVersion, err)
+		return true
+	}
+	return result > 0
+}
+
+// CompareVersions compares two dotted numeric versions, e.g. 3.0.196.0.
+// It returns a negative number if a < b, zero if a == b and a positive number if a > b.
+// Missing trailing components are treated as zero.
+func CompareVersions(a string, b string) (int, error) {
+	aParts, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bParts, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		if aPart != bPart {
+			return aPart - bPart, nil
+		}
+	}
+	return 0, nil
+}
+
+// parseVersion splits a dotted version into its numeric components
+func parseVersion(version string) ([]int, error) {
+	if version == "" {
+		return nil, fmt.Errorf("empty version")
+	}
+	parts := strings.Split(version, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		numbers[i] = number
+	}
+	return numbers, nil
+}
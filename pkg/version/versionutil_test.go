@@ -0,0 +1,76 @@
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package version contains CLI version constant and utilities.
+package version
+
+import (
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		sign    int
+		wantErr bool
+	}{
+		{a: "3.0.196.0", b: "3.0.196.0", sign: 0},
+		{a: "3.0.197.0", b: "3.0.196.0", sign: 1},
+		{a: "3.0.196.0", b: "3.1.1511.0", sign: -1},
+		// components compare numerically, not lexically
+		{a: "3.0.1000.0", b: "3.0.999.0", sign: 1},
+		{a: "10.0", b: "9.9", sign: 1},
+		// missing trailing components are zero
+		{a: "3.1", b: "3.1.0.0", sign: 0},
+		{a: "3.1.0.1", b: "3.1", sign: 1},
+		{a: "", b: "3.0.196.0", wantErr: true},
+		{a: "3.0.196.0", b: "", wantErr: true},
+		{a: "3.0.x.0", b: "3.0.196.0", wantErr: true},
+		{a: "3..196", b: "3.0.196", wantErr: true},
+		{a: "3.-1", b: "3.0", wantErr: true},
+	}
+	for _, test := range tests {
+		result, err := CompareVersions(test.a, test.b)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("CompareVersions(%q, %q) = %d, want error", test.a, test.b, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("CompareVersions(%q, %q) failed: %v", test.a, test.b, err)
+		} else if sign(result) != test.sign {
+			t.Errorf("CompareVersions(%q, %q) = %d, want sign %d", test.a, test.b, result, test.sign)
+		}
+	}
+}
+
+func TestDoesAgentSupportTCPMultiplexing(t *testing.T) {
+	tests := []struct {
+		agentVersion string
+		supported    bool
+	}{
+		{agentVersion: "", supported: false},
+		{agentVersion: "3.0.196.0", supported: false},
+		{agentVersion: "3.0.197.0", supported: true},
+		{agentVersion: "2.3.1644.0", supported: false},
+		// versions that cannot be parsed are treated as current agents
+		{agentVersion: "latest", supported: true},
+	}
+	for _, test := range tests {
+		if supported := DoesAgentSupportTCPMultiplexing(test.agentVersion); supported != test.supported {
+			t.Errorf("DoesAgentSupportTCPMultiplexing(%q) = %v, want %v", test.agentVersion, supported, test.supported)
+		}
+	}
+}
+
+// sign returns -1, 0 or 1 for negative, zero and positive numbers
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
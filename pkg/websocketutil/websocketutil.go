@@ -16,20 +16,47 @@ package websocketutil
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
 
 	"github.com/aws/session-manager-plugin/pkg/log"
+	"github.com/aws/session-manager-plugin/pkg/version"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	UserAgentHeader  = "User-Agent"
+	UserAgentProduct = "session-manager-plugin"
+)
+
 // IWebsocketUtil is the interface for the websocketutil.
 type IWebsocketUtil interface {
 	OpenConnection(url string) (*websocket.Conn, error)
 	CloseConnection(ws websocket.Conn) error
 }
 
+// WebsocketOptions contains optional settings applied to the websocket handshake.
+type WebsocketOptions struct {
+	// Headers are extra request headers sent with the handshake.
+	// Headers generated by the websocket library such as Upgrade or Sec-Websocket-Key are not allowed.
+	Headers http.Header
+	// UserAgent is a product token prepended to the plugin user agent, e.g. "mytool/1.2.0".
+	UserAgent string
+	// EnableCompression negotiates permessage-deflate compression with the service.
+	EnableCompression bool
+}
+
 // WebsocketUtil struct provides functionality around creating and maintaining websockets.
 type WebsocketUtil struct {
-	dialer *websocket.Dialer
+	dialer  *websocket.Dialer
+	options WebsocketOptions
+}
+
+// NewWebsocketUtilWithOptions is the factory function for websocketutil with handshake options.
+func NewWebsocketUtilWithOptions(dialerInput *websocket.Dialer, options WebsocketOptions) *WebsocketUtil {
+	websocketUtil := NewWebsocketUtil(dialerInput)
+	websocketUtil.options = options
+	return websocketUtil
 }
 
 // NewWebsocketUtil is the factory function for websocketutil.
@@ -55,13 +82,24 @@ func (u *WebsocketUtil) OpenConnection(url string) (*websocket.Conn, error) {
 
 	log.Infof("Opening websocket connection to: %s", url)
 
-	conn, _, err := u.dialer.Dial(url, nil)
+	dialer := u.dialer
+	if u.options.EnableCompression && !dialer.EnableCompression {
+		// copy the dialer so that the shared default dialer is left untouched
+		compressionDialer := *dialer
+		compressionDialer.EnableCompression = true
+		dialer = &compressionDialer
+	}
+
+	conn, response, err := dialer.Dial(url, u.options.requestHeader())
 	if err != nil {
 		log.Errorf("Failed to dial websocket: %s", err.Error())
 		return nil, err
 	}
 
 	log.Infof("Successfully opened websocket connection to: %s", url)
+	if u.options.EnableCompression && response != nil {
+		log.Debugf("Websocket extensions negotiated: %q", response.Header.Get("Sec-Websocket-Extensions"))
+	}
 
 	return conn, err
 }
@@ -85,3 +123,22 @@ func (u *WebsocketUtil) CloseConnection(ws *websocket.Conn) error {
 
 	return nil
 }
+
+// requestHeader builds the handshake request headers from the options.
+func (o WebsocketOptions) requestHeader() http.Header {
+	header := o.Headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set(UserAgentHeader, o.userAgent())
+	return header
+}
+
+// userAgent returns the user agent for the handshake, built from the plugin version.
+func (o WebsocketOptions) userAgent() string {
+	userAgent := fmt.Sprintf("%s/%s", UserAgentProduct, version.Version)
+	if o.UserAgent != "" {
+		userAgent = o.UserAgent + " " + userAgent
+	}
+	return userAgent
+}